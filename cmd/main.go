@@ -20,6 +20,9 @@ import (
 	"flag"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gig-tech/ovc-disk-csi-driver/driver"
 )
@@ -28,19 +31,84 @@ func main() {
 	var endpoint = flag.String("endpoint", "unix://tmp/csi.sock", "CSI Endpoint")
 	var url = flag.String("url", "", "OVC URL")
 	var account = flag.String("account", "", "Account name")
+	var authMode = flag.String("auth-mode", os.Getenv("OVC_AUTH_MODE"), "Authentication against OVC: jwt, with OVC_JWT or --jwt-file, or client-credentials, with OVC_CLIENT_ID and OVC_CLIENT_SECRET")
+	var jwtFile = flag.String("jwt-file", "", "File to read the OVC JWT from instead of OVC_JWT, reloaded when it changes")
 	var verbose = flag.Bool("verbose", false, "Set verbose output")
-	var attacher = flag.Bool("attacher", false, "Add this flag on the attacher container")
+	var mode = flag.String("mode", string(driver.AllMode), "Services to serve: controller, node or all")
+	var attacher = flag.Bool("attacher", false, "Deprecated: use --mode=controller instead")
+	var inventoryResync = flag.Duration("inventory-resync", 5*time.Minute, "Interval at which the inventory of attached disks is reconciled with OVC")
+	var debugAddress = flag.String("debug-address", "", "Address to serve debug endpoints like /debug/inventory on, disabled if empty")
+	var healthAddress = flag.String("health-address", "", "Address to serve the /healthz liveness endpoint on, disabled if empty")
+	var metricsAddress = flag.String("metrics-address", "", "Address to serve Prometheus metrics on at /metrics, disabled if empty")
+	var recoveryGracePeriod = flag.Duration("recovery-grace-period", 0, "Time a VM has to be halted or in error before its disks are detached to attach them to another node, disabled if 0")
+	var shutdownTimeout = flag.Duration("shutdown-timeout", 25*time.Second, "Time to wait for running requests and queued attaches and detaches to finish on SIGTERM")
+	var recoveryStopMachine = flag.Bool("recovery-stop-machine", false, "Force stop a halted or failed VM before detaching its disks during recovery")
+	var clusterID = flag.String("cluster-id", os.Getenv("OVC_CLUSTER_ID"), "ID of the cluster, stored on the disks created by the driver")
+	var gcInterval = flag.Duration("gc-interval", 0, "Interval at which disks created for the cluster that no PersistentVolume refers to are collected, disabled if 0. Requires --cluster-id. Only covers the account of the driver, not the accounts of StorageClass secrets")
+	var gcGracePeriod = flag.Duration("gc-grace-period", 24*time.Hour, "Time a disk has to be orphaned before it is deleted")
+	var gcDryRun = flag.Bool("gc-dry-run", false, "Only report orphaned disks instead of deleting them")
 	flag.Parse()
 
 	ovcJWT := os.Getenv("OVC_JWT")
 
 	print(verbose)
 
-	drv, err := driver.NewDriver(*url, *endpoint, *account, nil, ovcJWT, *verbose, *attacher)
+	driverMode, err := driver.ParseMode(*mode)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	driverAuthMode, err := driver.ParseAuthMode(*authMode)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if *attacher {
+		log.Println("The --attacher flag is deprecated and has no effect, attaches are handled in controller mode")
+	}
+
+	drv, err := driver.NewDriver(&driver.Config{
+		URL:      *url,
+		Endpoint: *endpoint,
+		Account:  *account,
+		JWT:      ovcJWT,
+		JWTFile:  *jwtFile,
+		Verbose:  *verbose,
+		Mode:     driverMode,
+
+		AuthMode:            driverAuthMode,
+		ClientID:            os.Getenv("OVC_CLIENT_ID"),
+		ClientSecret:        os.Getenv("OVC_CLIENT_SECRET"),
+		InventoryResync:     *inventoryResync,
+		DebugAddress:        *debugAddress,
+		MetricsAddress:      *metricsAddress,
+		HealthAddress:       *healthAddress,
+		RecoveryGracePeriod: *recoveryGracePeriod,
+		RecoveryStopMachine: *recoveryStopMachine,
+		ClusterID:           *clusterID,
+		GCInterval:          *gcInterval,
+		GCGracePeriod:       *gcGracePeriod,
+		GCDryRun:            *gcDryRun,
+		ShutdownTimeout:     *shutdownTimeout,
+		PodName:             os.Getenv("POD_NAME"),
+		PodNamespace:        os.Getenv("POD_NAMESPACE"),
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	// Run returns as soon as the driver stops listening, wait for the
+	// running operations to be drained before exiting
+	stopped := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s, stopping", sig)
+		drv.Stop()
+		close(stopped)
+	}()
+
 	if err := drv.Run(); err != nil {
 		log.Fatalln(err)
 	}
+	<-stopped
 }
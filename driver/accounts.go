@@ -0,0 +1,62 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+)
+
+// AccountDetails contains the resource limits of an account, which are not
+// returned by the account endpoints of the OVC SDK
+type AccountDetails struct {
+	ID             int                `json:"id"`
+	Name           string             `json:"name"`
+	Status         string             `json:"status"`
+	ResourceLimits ovc.ResourceLimits `json:"resourceLimits"`
+}
+
+// AccountDetailServiceOp handles communication with the account get endpoint
+// of the OVC API, which is not covered by the OVC SDK
+type AccountDetailServiceOp struct {
+	client *sdkClient
+}
+
+// Get returns the details of an account
+func (s *AccountDetailServiceOp) Get(ctx context.Context, accountID int) (*AccountDetails, error) {
+	accountIDMap := make(map[string]interface{})
+	accountIDMap["accountId"] = accountID
+
+	var body []byte
+	err := withContext(ctx, func() (err error) {
+		body, err = s.client.get().Post("/cloudapi/accounts/get", accountIDMap, ovc.ModelActionTimeout)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	account := new(AccountDetails)
+	err = json.Unmarshal(body, &account)
+	if err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
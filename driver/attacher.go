@@ -0,0 +1,668 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+)
+
+// inventoryRetryInterval is the time waited before retrying to create the
+// inventory of attached disks when it failed
+const inventoryRetryInterval = 30 * time.Second
+
+// attachStuckTimeout is how long an attach or detach can take before its
+// worker is considered stuck, the OVC API times out such operations after
+// 10 minutes
+const attachStuckTimeout = 15 * time.Minute
+
+// errAttacherStopped is returned for operations that were still queued when
+// the attacher stopped or that are requested while it is stopping
+var errAttacherStopped = status.Error(codes.Unavailable, "attacher is stopped")
+
+// attacherConfig contains the configuration of the attacher
+type attacherConfig struct {
+	// resync is the interval at which the inventory is reconciled
+	resync time.Duration
+	// recoveryGracePeriod is how long a machine has to be halted or in
+	// error before its disks are detached from it to attach them to another
+	// machine, recovery is disabled if it is 0
+	recoveryGracePeriod time.Duration
+	// recoveryStopMachine force stops the machine before detaching its
+	// disks during recovery
+	recoveryStopMachine bool
+	events              eventRecorder
+}
+
+// machineDown returns true if the OVC status of a machine means it isn't
+// running and won't release its disks by itself
+func machineDown(status string) bool {
+	return status == "HALTED" || status == "ERROR"
+}
+
+// attachOp is an operation on the attachment of a disk to a machine
+type attachOp string
+
+const (
+	attachOpAttach attachOp = "attach"
+	attachOpDetach attachOp = "detach"
+)
+
+// attachRequest is a queued attach or detach operation. Callers requesting
+// the same operation while it is pending share the request.
+type attachRequest struct {
+	op        attachOp
+	machineID int
+	diskID    int
+	done      chan struct{}
+	err       error
+	// started is when the worker started processing the request
+	started time.Time
+}
+
+type attachKey struct {
+	machineID int
+	diskID    int
+}
+
+// diskLock serializes the operations on a disk, it is removed once nobody
+// holds or waits for it
+type diskLock struct {
+	sync.Mutex
+	refs int
+}
+
+// attacher attaches disks to and detaches disks from machines. Every machine
+// has its own queue which is processed by a worker, so operations on
+// different machines run in parallel while operations on the same machine
+// keep their order. Operations on the same disk are serialized by a lock per
+// disk, as a disk can be moved from one machine to another.
+type attacher struct {
+	accountID int
+	config    attacherConfig
+	log       *logrus.Entry
+	inventory *inventory
+	now       func() time.Time
+
+	// ctx is canceled when the attacher stops, it is used for the API calls
+	// of the workers as requests are shared by callers with their own
+	// contexts
+	ctx    context.Context
+	cancel context.CancelFunc
+	ready  chan struct{}
+	// wg tracks the inventory resync, workers tracks the machine workers
+	wg      sync.WaitGroup
+	workers sync.WaitGroup
+
+	mu sync.Mutex
+	// client is the client the OVC API is called with
+	client *ovcClient
+	// stopping is set when the attacher stops, no requests are queued
+	// anymore from then on
+	stopping bool
+	// queues holds the requests per machine, the first one is being
+	// processed by the worker of the machine
+	queues map[int][]*attachRequest
+	// pending holds the last queued request per machine and disk
+	pending   map[attachKey]*attachRequest
+	diskLocks map[int]*diskLock
+	// coalesced counts the requests that joined a pending request
+	coalesced int
+	// downSince holds when machines were first seen halted or in error
+	downSince map[int]time.Time
+}
+
+// newAttacher returns an attacher for the disks of an account
+func newAttacher(client *ovcClient, accountID int, config attacherConfig, log *logrus.Entry) *attacher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &attacher{
+		ctx:       ctx,
+		cancel:    cancel,
+		client:    client,
+		accountID: accountID,
+		config:    config,
+		log:       log.WithField("component", "attacher"),
+		inventory: newInventory(),
+		now:       time.Now,
+		downSince: make(map[int]time.Time),
+		ready:     make(chan struct{}),
+		queues:    make(map[int][]*attachRequest),
+		pending:   make(map[attachKey]*attachRequest),
+		diskLocks: make(map[int]*diskLock),
+	}
+}
+
+// start creates the inventory of attached disks in the background and keeps
+// reconciling it, requests are processed once it is created
+func (a *attacher) start() {
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		a.log.Info("Creating inventory of attached disks")
+		for {
+			err := a.refresh()
+			if err == nil {
+				close(a.ready)
+				break
+			}
+			a.log.Warningf("Failed to create inventory of attached disks: %s. Retrying in %s", err, inventoryRetryInterval)
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-time.After(inventoryRetryInterval):
+			}
+		}
+
+		ticker := time.NewTicker(a.config.resync)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-ticker.C:
+				if err := a.refresh(); err != nil {
+					a.log.Warningf("Failed to reconcile inventory of attached disks: %s", err)
+				}
+			}
+		}
+	}()
+}
+
+// stop stops queuing requests and waits up to timeout for the queued
+// operations to finish. Operations still running after the timeout are
+// canceled and the ones still queued fail.
+func (a *attacher) stop(timeout time.Duration) {
+	a.mu.Lock()
+	a.stopping = true
+	a.mu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		a.workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		queued, _ := a.stats()
+		a.log.Warningf("Canceling %d attach and detach operations still queued after %s", queued, timeout)
+	}
+
+	a.cancel()
+	a.wg.Wait()
+	<-drained
+}
+
+// attach attaches a disk to a machine, detaching it first from the machine
+// it is attached to if that is another one
+func (a *attacher) attach(ctx context.Context, diskID, machineID int) error {
+	return a.submit(ctx, attachOpAttach, diskID, machineID)
+}
+
+// detach detaches a disk from a machine. If machineID is 0 the disk is
+// detached from any machine it is attached to.
+func (a *attacher) detach(ctx context.Context, diskID, machineID int) error {
+	return a.submit(ctx, attachOpDetach, diskID, machineID)
+}
+
+// submit queues an operation on the queue of the machine and waits for it
+// to finish or for ctx to be done. An operation abandoned by its callers
+// still runs, so the queue keeps its order and a retry of the caller can
+// join it while it is pending.
+func (a *attacher) submit(ctx context.Context, op attachOp, diskID, machineID int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	key := attachKey{machineID: machineID, diskID: diskID}
+
+	a.mu.Lock()
+	if a.stopping {
+		a.mu.Unlock()
+		return errAttacherStopped
+	}
+	if req, ok := a.pending[key]; ok && req.op == op {
+		a.coalesced++
+		a.mu.Unlock()
+		a.log.Debugf("Joining pending %s of disk %d on machine %d", op, diskID, machineID)
+		return req.wait(ctx)
+	}
+
+	req := &attachRequest{
+		op:        op,
+		machineID: machineID,
+		diskID:    diskID,
+		done:      make(chan struct{}),
+	}
+	a.pending[key] = req
+	a.queues[machineID] = append(a.queues[machineID], req)
+	if len(a.queues[machineID]) == 1 {
+		a.workers.Add(1)
+		go a.work(machineID)
+	}
+	a.mu.Unlock()
+
+	return req.wait(ctx)
+}
+
+// wait waits for the request to finish and returns its error, or the error
+// of ctx if it is done first
+func (req *attachRequest) wait(ctx context.Context) error {
+	select {
+	case <-req.done:
+		return req.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// work processes the queue of a machine until it is empty
+func (a *attacher) work(machineID int) {
+	defer a.workers.Done()
+
+	select {
+	case <-a.ready:
+	case <-a.ctx.Done():
+	}
+
+	for {
+		a.mu.Lock()
+		req := a.queues[machineID][0]
+		req.started = a.now()
+		a.mu.Unlock()
+
+		if a.ctx.Err() != nil {
+			req.err = errAttacherStopped
+		} else {
+			req.err = a.execute(req)
+		}
+
+		a.mu.Lock()
+		key := attachKey{machineID: req.machineID, diskID: req.diskID}
+		if a.pending[key] == req {
+			delete(a.pending, key)
+		}
+		a.queues[machineID] = a.queues[machineID][1:]
+		remaining := len(a.queues[machineID])
+		if remaining == 0 {
+			delete(a.queues, machineID)
+		}
+		a.mu.Unlock()
+
+		close(req.done)
+		if remaining == 0 {
+			return
+		}
+	}
+}
+
+// healthy returns an error if the attacher stopped or a worker is stuck on
+// a request for longer than the OVC API takes to time out
+func (a *attacher) healthy() error {
+	if a.ctx.Err() != nil {
+		return errAttacherStopped
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for machineID, queue := range a.queues {
+		req := queue[0]
+		if !req.started.IsZero() && a.now().Sub(req.started) > attachStuckTimeout {
+			return fmt.Errorf("worker of machine %d is stuck %sing disk %d since %s", machineID, req.op, req.diskID, req.started.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// stats returns the number of requests queued or in progress and the
+// number of requests that joined a pending request
+func (a *attacher) stats() (queued int, coalesced int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, queue := range a.queues {
+		queued += len(queue)
+	}
+	return queued, a.coalesced
+}
+
+func (a *attacher) execute(req *attachRequest) error {
+	unlock := a.lockDisk(req.diskID)
+	defer unlock()
+
+	var err error
+	switch req.op {
+	case attachOpAttach:
+		err = a.attachDisk(req.diskID, req.machineID)
+	case attachOpDetach:
+		err = a.detachDisk(req.diskID, req.machineID)
+	}
+	// Waiting for the recovery grace period isn't caused by a stale inventory
+	if err != nil && status.Code(err) != codes.Unavailable {
+		a.log.Infof("Error while executing %s request, refreshing inventory", req.op)
+		if err := a.refresh(); err != nil {
+			a.log.Warningf("Failed to refresh inventory of attached disks: %s", err)
+		}
+	}
+	return err
+}
+
+func (a *attacher) attachDisk(diskID, machineID int) error {
+	current, err := a.verifiedAttachment(diskID)
+	if err != nil {
+		return err
+	}
+	if current != nil && current.ID == machineID {
+		a.log.Infof("Nothing to do, disk %d is already attached to machine %d", diskID, machineID)
+		return nil
+	}
+
+	// Disk is attached to the wrong machine: disconnect
+	if current != nil {
+		if err := a.fence(diskID, current, machineID); err != nil {
+			return err
+		}
+		if err := a.detachFrom(diskID, current.ID); err != nil {
+			return err
+		}
+	}
+
+	if err := a.api().Disks.Attach(a.ctx, &ovc.DiskAttachConfig{
+		MachineID: machineID,
+		DiskID:    diskID,
+	}); err != nil {
+		a.log.Errorf("Failed to attach disk %d to machine %d: %s", diskID, machineID, err)
+		return err
+	}
+	a.setAttached(diskID, machineID)
+	a.log.Infof("Attached disk %d to machine %d", diskID, machineID)
+	return nil
+}
+
+func (a *attacher) detachDisk(diskID, machineID int) error {
+	current, err := a.verifiedAttachment(diskID)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		if current, err = a.unlistedAttachment(diskID, machineID); err != nil {
+			return err
+		}
+	}
+	if current == nil || (machineID != 0 && current.ID != machineID) {
+		a.log.Infof("Nothing to do, disk %d is not attached to machine %d", diskID, machineID)
+		return nil
+	}
+	return a.detachFrom(diskID, current.ID)
+}
+
+// fence prepares detaching a disk from a machine that is halted or in error
+// to attach it to another machine. The workload on the machine could still
+// be writing to the disk if the machine comes back, so this only happens
+// when recovery is enabled and the machine has been down for the grace
+// period. Until then an Unavailable error is returned so the request is
+// retried.
+func (a *attacher) fence(diskID int, machine *ovc.MachineInfo, targetID int) error {
+	if a.config.recoveryGracePeriod == 0 || !machineDown(machine.Status) {
+		return nil
+	}
+
+	down := a.now().Sub(a.machineDownSince(machine.ID))
+	if down < a.config.recoveryGracePeriod {
+		return status.Errorf(codes.Unavailable, "disk %d is attached to machine %d which is %s, it will be detached when the machine is down for %s",
+			diskID, machine.ID, machine.Status, a.config.recoveryGracePeriod)
+	}
+
+	a.log.Warningf("Fencing machine %d which is %s for %s to move disk %d to machine %d", machine.ID, machine.Status, down, diskID, targetID)
+	a.config.events.Eventf(v1.EventTypeWarning, "FencingMachine", "Machine %d is %s for %s, detaching disk %d from it to attach it to machine %d",
+		machine.ID, machine.Status, down.Round(time.Second), diskID, targetID)
+
+	if a.config.recoveryStopMachine {
+		if err := a.api().Machines.Stop(a.ctx, machine.ID, true); err != nil {
+			a.log.Errorf("Failed to stop machine %d: %s", machine.ID, err)
+			return err
+		}
+		a.log.Infof("Stopped machine %d", machine.ID)
+	}
+	return nil
+}
+
+// observeMachine records whether a machine is down, and since when
+func (a *attacher) observeMachine(machineID int, machineStatus string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !machineDown(machineStatus) {
+		delete(a.downSince, machineID)
+		return
+	}
+	if _, ok := a.downSince[machineID]; !ok {
+		a.log.Infof("Machine %d is %s", machineID, machineStatus)
+		a.downSince[machineID] = a.now()
+	}
+}
+
+// machineDownSince returns when a machine was first seen down
+func (a *attacher) machineDownSince(machineID int) time.Time {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.downSince[machineID]
+}
+
+func (a *attacher) detachFrom(diskID, machineID int) error {
+	if err := a.api().Disks.Detach(a.ctx, &ovc.DiskAttachConfig{
+		MachineID: machineID,
+		DiskID:    diskID,
+	}); err != nil {
+		a.log.Errorf("Failed to detach disk %d from machine %d: %s", diskID, machineID, err)
+		return err
+	}
+	a.forget(diskID)
+	a.log.Infof("Detached disk %d from machine %d", diskID, machineID)
+	return nil
+}
+
+// lockDisk locks the given disk and returns the function to unlock it
+func (a *attacher) lockDisk(diskID int) func() {
+	a.mu.Lock()
+	l, ok := a.diskLocks[diskID]
+	if !ok {
+		l = &diskLock{}
+		a.diskLocks[diskID] = l
+	}
+	l.refs++
+	a.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		a.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(a.diskLocks, diskID)
+		}
+		a.mu.Unlock()
+	}
+}
+
+// verifiedAttachment returns the machine a disk is attached to, or nil. The
+// inventory is only used as a cache: the attachment it holds is verified
+// against the machine before acting on it, so a stale entry never causes the
+// disk to be detached from the wrong machine.
+func (a *attacher) verifiedAttachment(diskID int) (*ovc.MachineInfo, error) {
+	machineID, attached := a.inventory.get(diskID)
+	if !attached {
+		return nil, nil
+	}
+	machine, err := a.getMachine(machineID)
+	if err != nil {
+		return nil, err
+	}
+	if machine == nil {
+		a.log.Warningf("Machine %d of disk %d no longer exists, updating inventory", machineID, diskID)
+		a.inventory.forget(diskID)
+		return nil, nil
+	}
+	a.observeMachine(machine.ID, machine.Status)
+	for _, disk := range machine.Disks {
+		if disk.ID == diskID {
+			return machine, nil
+		}
+	}
+	a.log.Warningf("Disk %d is no longer attached to machine %d, updating inventory", diskID, machineID)
+	a.inventory.forget(diskID)
+	return nil, nil
+}
+
+// unlistedAttachment checks with the OVC API whether a disk that isn't in
+// the inventory is attached anyway, as it could have been attached outside of
+// the driver since the inventory was last reconciled. Only the given machine
+// is checked, or all machines of the account if machineID is 0.
+func (a *attacher) unlistedAttachment(diskID, machineID int) (*ovc.MachineInfo, error) {
+	if machineID == 0 {
+		if err := a.refresh(); err != nil {
+			return nil, err
+		}
+		return a.verifiedAttachment(diskID)
+	}
+
+	machine, err := a.getMachine(machineID)
+	if machine == nil {
+		return nil, err
+	}
+	a.observeMachine(machine.ID, machine.Status)
+	for _, disk := range machine.Disks {
+		if disk.ID == diskID {
+			a.log.Infof("Disk %d was attached to machine %d outside of the driver", diskID, machineID)
+			a.setAttached(diskID, machineID)
+			return machine, nil
+		}
+	}
+	return nil, nil
+}
+
+// getMachine returns the given machine, or nil if it no longer exists. The
+// OVC SDK returns the response body as error when the API can't find a
+// machine, which doesn't tell a missing machine apart from other failures,
+// so a machine is only considered missing if it isn't listed in the
+// cloudspaces of the account either.
+func (a *attacher) getMachine(machineID int) (*ovc.MachineInfo, error) {
+	machine, err := a.api().Machines.Get(a.ctx, machineID)
+	switch errorCode(err) {
+	case codes.OK:
+		return machine, nil
+	case codes.NotFound:
+		return nil, nil
+	case codes.Internal:
+		listed, listErr := a.machineListed(machineID)
+		if listErr == nil && !listed {
+			return nil, nil
+		}
+	}
+	return nil, err
+}
+
+// machineListed reports whether the given machine is in one of the
+// cloudspaces of the account
+func (a *attacher) machineListed(machineID int) (bool, error) {
+	cloudspaces, err := a.api().CloudSpaces.List(a.ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, cloudspace := range *cloudspaces {
+		if cloudspace.AccountID != a.accountID {
+			continue
+		}
+		machines, err := a.api().Machines.List(a.ctx, cloudspace.ID)
+		if err != nil {
+			return false, err
+		}
+		for _, machine := range *machines {
+			if machine.ID == machineID {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// api returns the client the attacher calls the OVC API with
+func (a *attacher) api() *ovcClient {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.client
+}
+
+// setClient replaces the client the attacher calls the OVC API with, so
+// rotated credentials are picked up
+func (a *attacher) setClient(client *ovcClient) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.client = client
+}
+
+func (a *attacher) setAttached(diskID, machineID int) {
+	a.inventory.set(diskID, machineID)
+}
+
+// forget removes a disk from the inventory after it was detached or deleted
+func (a *attacher) forget(diskID int) {
+	a.inventory.forget(diskID)
+}
+
+// refresh reconciles the inventory with the disks attached to the machines
+// of all cloudspaces of the account, as the controller doesn't necessarily
+// run in the cloudspace of the nodes
+func (a *attacher) refresh() error {
+	since := a.inventory.begin()
+	cloudspaces, err := a.api().CloudSpaces.List(a.ctx)
+	if err != nil {
+		return err
+	}
+	disks := make(map[int]int)
+	for _, cloudspace := range *cloudspaces {
+		if cloudspace.AccountID != a.accountID {
+			continue
+		}
+		machines, err := a.api().Machines.List(a.ctx, cloudspace.ID)
+		if err != nil {
+			return err
+		}
+		for _, machine := range *machines {
+			a.observeMachine(machine.ID, machine.Status)
+			for _, diskID := range machine.Disks {
+				disks[diskID] = machine.ID
+			}
+		}
+	}
+
+	for _, change := range a.inventory.reconcile(disks, since) {
+		switch {
+		case change.from == 0:
+			a.log.Infof("Disk %d was attached to machine %d outside of the driver", change.diskID, change.to)
+		case change.to == 0:
+			a.log.Infof("Disk %d was detached from machine %d outside of the driver", change.diskID, change.from)
+		default:
+			a.log.Infof("Disk %d was moved from machine %d to machine %d outside of the driver", change.diskID, change.from, change.to)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,541 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func newTestAttacher(tb testing.TB, f *fakeOVC) *attacher {
+	return newTestAttacherWithConfig(tb, f, attacherConfig{})
+}
+
+func newTestAttacherWithConfig(tb testing.TB, f *fakeOVC, config attacherConfig) *attacher {
+	log := logrus.New()
+	log.SetLevel(logrus.WarnLevel)
+	if config.resync == 0 {
+		config.resync = defaultInventoryResync
+	}
+	if config.events == nil {
+		config.events = &fakeEventRecorder{}
+	}
+	a := newAttacher(f.client(), f.accountID(), config, logrus.NewEntry(log))
+	a.start()
+	tb.Cleanup(func() { a.stop(0) })
+	return a
+}
+
+// fakeEventRecorder records the reasons of events
+type fakeEventRecorder struct {
+	mu      sync.Mutex
+	reasons []string
+}
+
+func (r *fakeEventRecorder) Eventf(eventType, reason, messageFmt string, args ...interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reasons = append(r.reasons, reason)
+}
+
+// async runs fn in the background and returns a channel receiving its result
+func async(fn func() error) chan error {
+	result := make(chan error, 1)
+	go func() {
+		result <- fn()
+	}()
+	return result
+}
+
+// waitFor polls cond until it is true and fails the test if that takes more
+// than a second
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestAttacherMachinesInParallel(t *testing.T) {
+	f := newFakeOVC()
+	cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+	machines := []int{f.addMachine(cloudspaceID), f.addMachine(cloudspaceID)}
+	disks := []int{f.addDisk(f.accountID(), "pvc-1", 10), f.addDisk(f.accountID(), "pvc-2", 10)}
+	a := newTestAttacher(t, f)
+
+	release := f.hold("Disks.Attach")
+	first := async(func() error { return a.attach(context.Background(), disks[0], machines[0]) })
+	second := async(func() error { return a.attach(context.Background(), disks[1], machines[1]) })
+
+	// Both attaches are in flight at the same time
+	waitFor(t, func() bool { return f.callCount("Disks.Attach") == 2 })
+	release()
+
+	require.NoError(t, <-first)
+	require.NoError(t, <-second)
+	require.Equal(t, machines[0], f.attachedTo(disks[0]))
+	require.Equal(t, machines[1], f.attachedTo(disks[1]))
+}
+
+func TestAttacherMachineOperationsOrdered(t *testing.T) {
+	f := newFakeOVC()
+	cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+	machineID := f.addMachine(cloudspaceID)
+	diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+	a := newTestAttacher(t, f)
+
+	release := f.hold("Disks.Attach")
+	attached := async(func() error { return a.attach(context.Background(), diskID, machineID) })
+	waitFor(t, func() bool { return f.callCount("Disks.Attach") == 1 })
+	detached := async(func() error { return a.detach(context.Background(), diskID, machineID) })
+
+	// The detach waits for the attach to finish
+	time.Sleep(20 * time.Millisecond)
+	require.Zero(t, f.callCount("Disks.Detach"))
+	release()
+
+	require.NoError(t, <-attached)
+	require.NoError(t, <-detached)
+	require.Equal(t, 1, f.callCount("Disks.Detach"))
+	require.Zero(t, f.attachedTo(diskID))
+}
+
+func TestAttacherCoalescesRequests(t *testing.T) {
+	f := newFakeOVC()
+	cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+	machineID := f.addMachine(cloudspaceID)
+	diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+	a := newTestAttacher(t, f)
+
+	release := f.hold("Disks.Attach")
+	first := async(func() error { return a.attach(context.Background(), diskID, machineID) })
+	waitFor(t, func() bool { return f.callCount("Disks.Attach") == 1 })
+	second := async(func() error { return a.attach(context.Background(), diskID, machineID) })
+	waitFor(t, func() bool {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		return a.coalesced == 1
+	})
+	release()
+
+	require.NoError(t, <-first)
+	require.NoError(t, <-second)
+	require.Equal(t, 1, f.callCount("Disks.Attach"))
+	require.Equal(t, machineID, f.attachedTo(diskID))
+}
+
+func TestAttacherAbandonedRequest(t *testing.T) {
+	f := newFakeOVC()
+	cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+	machineID := f.addMachine(cloudspaceID)
+	disks := []int{f.addDisk(f.accountID(), "pvc-1", 10), f.addDisk(f.accountID(), "pvc-2", 10)}
+	a := newTestAttacher(t, f)
+
+	release := f.hold("Disks.Attach")
+	ctx, cancel := context.WithCancel(context.Background())
+	abandoned := async(func() error { return a.attach(ctx, disks[0], machineID) })
+	waitFor(t, func() bool { return f.callCount("Disks.Attach") == 1 })
+	cancel()
+	require.Equal(t, context.Canceled, <-abandoned)
+	release()
+
+	// The abandoned attach still completes and doesn't block the queue
+	require.NoError(t, a.attach(context.Background(), disks[1], machineID))
+	require.Equal(t, machineID, f.attachedTo(disks[0]))
+	require.Equal(t, machineID, f.attachedTo(disks[1]))
+}
+
+func TestAttacherStop(t *testing.T) {
+	tt := []struct {
+		name    string
+		timeout time.Duration
+		drained bool
+	}{
+		{
+			name:    "drained",
+			timeout: time.Second,
+			drained: true,
+		},
+		{
+			name:    "timed out",
+			timeout: 10 * time.Millisecond,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+			machines := []int{f.addMachine(cloudspaceID), f.addMachine(cloudspaceID)}
+			disks := []int{f.addDisk(f.accountID(), "pvc-1", 10), f.addDisk(f.accountID(), "pvc-2", 10)}
+			a := newTestAttacher(t, f)
+
+			release := f.hold("Disks.Attach")
+			running := async(func() error { return a.attach(context.Background(), disks[0], machines[0]) })
+			waitFor(t, func() bool { return f.callCount("Disks.Attach") == 1 })
+			queued := async(func() error { return a.attach(context.Background(), disks[1], machines[0]) })
+			waitFor(t, func() bool {
+				n, _ := a.stats()
+				return n == 2
+			})
+
+			stopped := async(func() error {
+				a.stop(tc.timeout)
+				return nil
+			})
+			waitFor(t, func() bool {
+				a.mu.Lock()
+				defer a.mu.Unlock()
+				return a.stopping
+			})
+			// No new requests are queued while stopping
+			require.Equal(t, errAttacherStopped, a.attach(context.Background(), disks[1], machines[1]))
+
+			if tc.drained {
+				release()
+			} else {
+				t.Cleanup(release)
+			}
+			<-stopped
+
+			if tc.drained {
+				require.NoError(t, <-running)
+				require.NoError(t, <-queued)
+				require.Equal(t, machines[0], f.attachedTo(disks[0]))
+				require.Equal(t, machines[0], f.attachedTo(disks[1]))
+			} else {
+				require.Error(t, <-running)
+				require.Equal(t, errAttacherStopped, <-queued)
+				require.Zero(t, f.attachedTo(disks[1]))
+			}
+		})
+	}
+}
+
+func TestAttacherReconcilesInventory(t *testing.T) {
+	f := newFakeOVC()
+	cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+	machines := []int{f.addMachine(cloudspaceID), f.addMachine(cloudspaceID)}
+	moved := f.addDisk(f.accountID(), "pvc-1", 10)
+	detached := f.addDisk(f.accountID(), "pvc-2", 10)
+	attached := f.addDisk(f.accountID(), "pvc-3", 10)
+	a := newTestAttacher(t, f)
+	require.NoError(t, a.attach(context.Background(), moved, machines[0]))
+	require.NoError(t, a.attach(context.Background(), detached, machines[0]))
+
+	// Changes made in the portal
+	f.detachDisk(moved)
+	f.attachDisk(moved, machines[1])
+	f.detachDisk(detached)
+	f.attachDisk(attached, machines[1])
+
+	require.NoError(t, a.refresh())
+	for diskID, machineID := range map[int]int{moved: machines[1], detached: 0, attached: machines[1]} {
+		current, _ := a.inventory.get(diskID)
+		require.Equal(t, machineID, current, "disk %d", diskID)
+	}
+}
+
+func TestAttacherVerifiesBeforeDetach(t *testing.T) {
+	tt := []struct {
+		name string
+		// portal changes the attachment of the disk outside of the driver
+		portal   func(f *fakeOVC, diskID int, machines []int)
+		detaches int
+		// attachedTo is the index of the machine the disk is attached to
+		// after unpublishing, or -1
+		attachedTo int
+	}{
+		{
+			name:       "inventory up to date",
+			portal:     func(f *fakeOVC, diskID int, machines []int) {},
+			detaches:   1,
+			attachedTo: -1,
+		},
+		{
+			name: "detached in portal",
+			portal: func(f *fakeOVC, diskID int, machines []int) {
+				f.detachDisk(diskID)
+			},
+			detaches:   0,
+			attachedTo: -1,
+		},
+		{
+			name: "moved in portal",
+			portal: func(f *fakeOVC, diskID int, machines []int) {
+				f.detachDisk(diskID)
+				f.attachDisk(diskID, machines[1])
+			},
+			detaches:   0,
+			attachedTo: 1,
+		},
+		{
+			name: "machine deleted in portal",
+			portal: func(f *fakeOVC, diskID int, machines []int) {
+				f.deleteMachine(machines[0])
+			},
+			detaches:   0,
+			attachedTo: -1,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+			machines := []int{f.addMachine(cloudspaceID), f.addMachine(cloudspaceID)}
+			diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+			f.attachDisk(diskID, machines[0])
+			a := newTestAttacher(t, f)
+			require.NoError(t, a.attach(context.Background(), diskID, machines[0]))
+
+			tc.portal(f, diskID, machines)
+			require.NoError(t, a.detach(context.Background(), diskID, machines[0]))
+			require.Equal(t, tc.detaches, f.callCount("Disks.Detach"))
+			if tc.attachedTo < 0 {
+				require.Zero(t, f.attachedTo(diskID))
+				_, attached := a.inventory.get(diskID)
+				require.False(t, attached)
+			} else {
+				require.Equal(t, machines[tc.attachedTo], f.attachedTo(diskID))
+			}
+		})
+	}
+}
+
+func TestAttacherMachineLookupFails(t *testing.T) {
+	f := newFakeOVC()
+	cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+	machineID := f.addMachine(cloudspaceID)
+	diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+	f.attachDisk(diskID, machineID)
+	a := newTestAttacher(t, f)
+	require.NoError(t, a.attach(context.Background(), diskID, machineID))
+
+	// A machine that is still listed isn't taken for deleted, whatever the
+	// failing lookup says
+	f.failOn("Machines.Get", errNotFound("cloudspace", cloudspaceID))
+	require.Error(t, a.detach(context.Background(), diskID, machineID))
+	require.Equal(t, machineID, f.attachedTo(diskID))
+	attachedTo, attached := a.inventory.get(diskID)
+	require.True(t, attached)
+	require.Equal(t, machineID, attachedTo)
+}
+
+func TestAttacherDetachesDiskMissingFromInventory(t *testing.T) {
+	tt := []struct {
+		name string
+		// machine is the index of the machine to detach from, or -1 to
+		// detach from any machine
+		machine int
+	}{
+		{name: "from machine", machine: 0},
+		{name: "from any machine", machine: -1},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+			machines := []int{f.addMachine(cloudspaceID)}
+			diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+			a := newTestAttacher(t, f)
+			<-a.ready
+
+			// Attached in the portal after the inventory was created
+			f.attachDisk(diskID, machines[0])
+			machineID := 0
+			if tc.machine >= 0 {
+				machineID = machines[tc.machine]
+			}
+			require.NoError(t, a.detach(context.Background(), diskID, machineID))
+			require.Equal(t, 1, f.callCount("Disks.Detach"))
+			require.Zero(t, f.attachedTo(diskID))
+		})
+	}
+}
+
+func TestAttacherRecovery(t *testing.T) {
+	const gracePeriod = 5 * time.Minute
+
+	tt := []struct {
+		name   string
+		status string
+		config attacherConfig
+		// down is how long the machine is down when publishing on the
+		// other machine
+		down  time.Duration
+		code  codes.Code
+		stops int
+		fence bool
+	}{
+		{
+			name:   "running machine",
+			status: "RUNNING",
+			config: attacherConfig{recoveryGracePeriod: gracePeriod},
+			code:   codes.OK,
+		},
+		{
+			name:   "recovery disabled",
+			status: "HALTED",
+			down:   time.Hour,
+			code:   codes.OK,
+		},
+		{
+			name:   "within grace period",
+			status: "HALTED",
+			config: attacherConfig{recoveryGracePeriod: gracePeriod},
+			down:   time.Minute,
+			code:   codes.Unavailable,
+		},
+		{
+			name:   "halted machine",
+			status: "HALTED",
+			config: attacherConfig{recoveryGracePeriod: gracePeriod},
+			down:   gracePeriod,
+			code:   codes.OK,
+			fence:  true,
+		},
+		{
+			name:   "machine in error is stopped",
+			status: "ERROR",
+			config: attacherConfig{recoveryGracePeriod: gracePeriod, recoveryStopMachine: true},
+			down:   gracePeriod,
+			code:   codes.OK,
+			stops:  1,
+			fence:  true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+			machines := []int{f.addMachine(cloudspaceID), f.addMachine(cloudspaceID)}
+			diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+			f.attachDisk(diskID, machines[0])
+			f.setMachineStatus(machines[0], tc.status)
+
+			events := &fakeEventRecorder{}
+			tc.config.events = events
+			now := time.Now()
+			a := newTestAttacherWithConfig(t, f, tc.config)
+			a.now = func() time.Time { return now }
+
+			// The machine is seen down by the first attempt
+			err := a.attach(context.Background(), diskID, machines[1])
+			if tc.down > 0 && tc.config.recoveryGracePeriod > 0 {
+				require.Equal(t, codes.Unavailable, status.Code(err))
+			}
+			now = now.Add(tc.down)
+
+			err = a.attach(context.Background(), diskID, machines[1])
+			require.Equal(t, tc.code, status.Code(err), "unexpected error: %v", err)
+			require.Equal(t, tc.stops, f.callCount("Machines.Stop"))
+			if tc.fence {
+				require.Equal(t, []string{"FencingMachine"}, events.reasons)
+			} else {
+				require.Empty(t, events.reasons)
+			}
+			if tc.code == codes.OK {
+				require.Equal(t, machines[1], f.attachedTo(diskID))
+			} else {
+				require.Equal(t, machines[0], f.attachedTo(diskID))
+			}
+		})
+	}
+}
+
+func TestInventoryReconcileKeepsLocalChanges(t *testing.T) {
+	inv := newInventory()
+	inv.reconcile(map[int]int{1: 10, 2: 10}, inv.begin())
+
+	// Disk 1 is detached and disk 3 attached while the machines are listed
+	since := inv.begin()
+	inv.forget(1)
+	inv.set(3, 10)
+	changes := inv.reconcile(map[int]int{1: 10, 2: 20}, since)
+
+	require.Equal(t, []inventoryChange{{diskID: 2, from: 10, to: 20}}, changes)
+	_, attached := inv.get(1)
+	require.False(t, attached)
+	machineID, _ := inv.get(3)
+	require.Equal(t, 10, machineID)
+}
+
+func TestDebugInventory(t *testing.T) {
+	f := newFakeOVC()
+	cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+	machineID := f.addMachine(cloudspaceID)
+	diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+	f.attachDisk(diskID, machineID)
+	d := newTestDriver(t, f)
+	waitFor(t, func() bool {
+		_, attached := d.attacher.inventory.get(diskID)
+		return attached
+	})
+
+	rec := httptest.NewRecorder()
+	d.debugHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/debug/inventory", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var contents struct {
+		Disks map[int]int `json:"disks"`
+	}
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&contents))
+	require.Equal(t, map[int]int{diskID: machineID}, contents.Disks)
+}
+
+// BenchmarkAttacher publishes and unpublishes 16 volumes concurrently on a
+// varying number of machines, with 1ms of latency per API call. With a single
+// machine all operations are serialized, like they were with the former
+// global state machine.
+func BenchmarkAttacher(b *testing.B) {
+	const volumes = 16
+
+	for _, machineCount := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("machines=%d", machineCount), func(b *testing.B) {
+			f := newFakeOVC()
+			cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+			var machines, disks []int
+			for i := 0; i < machineCount; i++ {
+				machines = append(machines, f.addMachine(cloudspaceID))
+			}
+			for i := 0; i < volumes; i++ {
+				disks = append(disks, f.addDisk(f.accountID(), fmt.Sprintf("pvc-%d", i), 10))
+			}
+			f.latency = time.Millisecond
+			a := newTestAttacher(b, f)
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				var wg sync.WaitGroup
+				for i, diskID := range disks {
+					wg.Add(1)
+					go func(diskID, machineID int) {
+						defer wg.Done()
+						if err := a.attach(context.Background(), diskID, machineID); err != nil {
+							b.Error(err)
+						}
+						if err := a.detach(context.Background(), diskID, machineID); err != nil {
+							b.Error(err)
+						}
+					}(diskID, machines[i%machineCount])
+				}
+				wg.Wait()
+			}
+		})
+	}
+}
@@ -0,0 +1,432 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// diskService contains the disk operations of the OVC API used by the driver
+type diskService interface {
+	List(context.Context, int, string) (*[]ovc.Disk, error)
+	Get(context.Context, int) (*ovc.DiskInfo, error)
+	Create(context.Context, *ovc.DiskConfig) (int, error)
+	Attach(context.Context, *ovc.DiskAttachConfig) error
+	Detach(context.Context, *ovc.DiskAttachConfig) error
+	Delete(context.Context, *ovc.DiskDeleteConfig) error
+	Resize(context.Context, *ovc.DiskConfig) error
+}
+
+// machineService contains the machine operations of the OVC API used by the
+// driver
+type machineService interface {
+	List(context.Context, int) (*[]ovc.Machine, error)
+	Get(context.Context, int) (*ovc.MachineInfo, error)
+	GetByReferenceID(context.Context, string) (*ovc.MachineInfo, error)
+	Stop(context.Context, int, bool) error
+}
+
+// accountService contains the account operations of the OVC API used by the
+// driver
+type accountService interface {
+	GetIDByName(context.Context, string) (int, error)
+	Get(context.Context, int) (*AccountDetails, error)
+}
+
+// cloudSpaceService contains the cloudspace operations of the OVC API used by
+// the driver
+type cloudSpaceService interface {
+	List(context.Context) (*[]ovc.CloudSpaceInfo, error)
+	Get(context.Context, int) (*ovc.CloudSpace, error)
+}
+
+// locationService contains the location operations of the OVC API used by the
+// driver
+type locationService interface {
+	List(context.Context) (*ovc.LocationList, error)
+}
+
+// jwtService gives access to the JWT used to authenticate against the OVC API
+type jwtService interface {
+	Get(context.Context) (string, error)
+	Set(string) error
+}
+
+// ovcClient bundles the operations of the OVC API used by the driver, so they
+// can be replaced by a fake implementation in tests
+type ovcClient struct {
+	Disks       diskService
+	Machines    machineService
+	Accounts    accountService
+	CloudSpaces cloudSpaceService
+	Locations   locationService
+	JWT         jwtService
+}
+
+// newOVCClient returns an ovcClient which talks to the OVC API through the
+// OVC SDK
+func newOVCClient(config *ovc.Config) (*ovcClient, error) {
+	c, err := ovc.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	client := newSDKClient(c)
+	jwt := &jwtServiceOp{client: client, config: *config, newClient: ovc.NewClient}
+	if config.ClientID != "" {
+		client.renew = jwt.renew
+	}
+
+	return &ovcClient{
+		Disks:       &diskServiceOp{client},
+		Machines:    &machineServiceOp{client},
+		Accounts:    &accountServiceOp{client, &AccountDetailServiceOp{client: client}},
+		CloudSpaces: &cloudSpaceServiceOp{client},
+		Locations:   &locationServiceOp{client},
+		JWT:         jwt,
+	}, nil
+}
+
+// sdkClient holds the OVC SDK client. The client is replaced as a whole when
+// the JWT is rotated, as the SDK can't change the JWT of a client.
+type sdkClient struct {
+	current atomic.Value
+	// renew fetches a new JWT with client credentials, it is nil if the
+	// client authenticates with a JWT
+	renew func() error
+}
+
+func newSDKClient(client *ovc.Client) *sdkClient {
+	c := &sdkClient{}
+	c.set(client)
+	return c
+}
+
+// get returns the current OVC SDK client. A JWT fetched with client
+// credentials is renewed first if it is about to expire, so API calls don't
+// fail in between the checks of the JWT maintainer.
+func (c *sdkClient) get() *ovc.Client {
+	client := c.load()
+	if c.renew == nil {
+		return client
+	}
+	if jwt, err := client.JWT.Get(); err == nil && !jwtExpiresWithin(jwt, jwtRenewBefore) {
+		return client
+	}
+	// If renewing fails the call is made with the current JWT, which reports
+	// the error
+	if err := c.renew(); err != nil {
+		return client
+	}
+	return c.load()
+}
+
+// load returns the current OVC SDK client as is
+func (c *sdkClient) load() *ovc.Client {
+	return c.current.Load().(*ovc.Client)
+}
+
+// set replaces the OVC SDK client, calls in progress keep using the
+// previous one
+func (c *sdkClient) set(client *ovc.Client) {
+	c.current.Store(client)
+}
+
+// withContext runs an OVC API call, which the OVC SDK can't cancel, and
+// returns the error of the context as soon as the context is done. The call
+// keeps running in the background in that case and its result is dropped,
+// so call must not write to variables the caller reads after an error.
+func withContext(ctx context.Context, call func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	result := make(chan error, 1)
+	go func() {
+		result <- call()
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// diskServiceOp adds context support to the disk operations of the OVC SDK
+type diskServiceOp struct {
+	client *sdkClient
+}
+
+func (s *diskServiceOp) List(ctx context.Context, accountID int, diskType string) (*[]ovc.Disk, error) {
+	var disks *[]ovc.Disk
+	err := withContext(ctx, func() (err error) {
+		disks, err = s.client.get().Disks.List(accountID, diskType)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return disks, nil
+}
+
+func (s *diskServiceOp) Get(ctx context.Context, diskID int) (*ovc.DiskInfo, error) {
+	var disk *ovc.DiskInfo
+	err := withContext(ctx, func() (err error) {
+		disk, err = s.client.get().Disks.Get(diskID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return disk, nil
+}
+
+func (s *diskServiceOp) Create(ctx context.Context, diskConfig *ovc.DiskConfig) (int, error) {
+	var diskID int
+	err := withContext(ctx, func() (err error) {
+		diskID, err = s.client.get().Disks.Create(diskConfig)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return diskID, nil
+}
+
+func (s *diskServiceOp) Attach(ctx context.Context, attachConfig *ovc.DiskAttachConfig) error {
+	return withContext(ctx, func() error {
+		return s.client.get().Disks.Attach(attachConfig)
+	})
+}
+
+func (s *diskServiceOp) Detach(ctx context.Context, attachConfig *ovc.DiskAttachConfig) error {
+	return withContext(ctx, func() error {
+		return s.client.get().Disks.Detach(attachConfig)
+	})
+}
+
+func (s *diskServiceOp) Delete(ctx context.Context, deleteConfig *ovc.DiskDeleteConfig) error {
+	return withContext(ctx, func() error {
+		return s.client.get().Disks.Delete(deleteConfig)
+	})
+}
+
+func (s *diskServiceOp) Resize(ctx context.Context, diskConfig *ovc.DiskConfig) error {
+	return withContext(ctx, func() error {
+		return s.client.get().Disks.Resize(diskConfig)
+	})
+}
+
+// machineServiceOp adds context support to the machine operations of the
+// OVC SDK
+type machineServiceOp struct {
+	client *sdkClient
+}
+
+func (s *machineServiceOp) List(ctx context.Context, cloudspaceID int) (*[]ovc.Machine, error) {
+	var machines *[]ovc.Machine
+	err := withContext(ctx, func() (err error) {
+		machines, err = s.client.get().Machines.List(cloudspaceID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return machines, nil
+}
+
+func (s *machineServiceOp) Get(ctx context.Context, machineID int) (*ovc.MachineInfo, error) {
+	var machine *ovc.MachineInfo
+	err := withContext(ctx, func() (err error) {
+		machine, err = s.client.get().Machines.Get(machineID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return machine, nil
+}
+
+func (s *machineServiceOp) GetByReferenceID(ctx context.Context, referenceID string) (*ovc.MachineInfo, error) {
+	var machine *ovc.MachineInfo
+	err := withContext(ctx, func() (err error) {
+		machine, err = s.client.get().Machines.GetByReferenceID(referenceID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return machine, nil
+}
+
+func (s *machineServiceOp) Stop(ctx context.Context, machineID int, force bool) error {
+	return withContext(ctx, func() error {
+		return s.client.get().Machines.Stop(machineID, force)
+	})
+}
+
+// accountServiceOp combines the account operations of the OVC SDK with the
+// ones the SDK doesn't cover
+type accountServiceOp struct {
+	client *sdkClient
+	*AccountDetailServiceOp
+}
+
+// GetIDByName looks the account up in the list of accounts itself, as the
+// OVC SDK returns a plain error for an account that isn't listed, which can't
+// be told apart from a failure of the API
+func (s *accountServiceOp) GetIDByName(ctx context.Context, name string) (int, error) {
+	var accounts *[]ovc.AccountInfo
+	err := withContext(ctx, func() (err error) {
+		accounts, err = s.client.get().Accounts.List()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	for _, account := range *accounts {
+		if account.Name == name {
+			return account.ID, nil
+		}
+	}
+	return 0, status.Errorf(codes.NotFound, "account %s not found", name)
+}
+
+// cloudSpaceServiceOp adds context support to the cloudspace operations of
+// the OVC SDK
+type cloudSpaceServiceOp struct {
+	client *sdkClient
+}
+
+func (s *cloudSpaceServiceOp) List(ctx context.Context) (*[]ovc.CloudSpaceInfo, error) {
+	var cloudspaces *[]ovc.CloudSpaceInfo
+	err := withContext(ctx, func() (err error) {
+		cloudspaces, err = s.client.get().CloudSpaces.List()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cloudspaces, nil
+}
+
+func (s *cloudSpaceServiceOp) Get(ctx context.Context, cloudspaceID int) (*ovc.CloudSpace, error) {
+	var cloudspace *ovc.CloudSpace
+	err := withContext(ctx, func() (err error) {
+		cloudspace, err = s.client.get().CloudSpaces.Get(cloudspaceID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cloudspace, nil
+}
+
+// locationServiceOp adds context support to the location operations of the
+// OVC SDK
+type locationServiceOp struct {
+	client *sdkClient
+}
+
+func (s *locationServiceOp) List(ctx context.Context) (*ovc.LocationList, error) {
+	var locations *ovc.LocationList
+	err := withContext(ctx, func() (err error) {
+		locations, err = s.client.get().Locations.List()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return locations, nil
+}
+
+// jwtServiceOp adds context support to the JWT operations of the OVC SDK
+type jwtServiceOp struct {
+	client *sdkClient
+	// config is the configuration the client was created with
+	config ovc.Config
+	// newClient creates an OVC SDK client, which fetches a JWT when it is
+	// given client credentials
+	newClient func(*ovc.Config) (*ovc.Client, error)
+	// mu serializes fetching new JWTs with client credentials
+	mu sync.Mutex
+}
+
+func (s *jwtServiceOp) Get(ctx context.Context) (string, error) {
+	jwt, err := s.get(ctx)
+	if s.config.ClientID == "" {
+		return jwt, err
+	}
+
+	// JWTs fetched with client credentials can't be refreshed, a new one is
+	// fetched before the SDK considers it expired
+	if err == ovc.ErrExpiredJWT || (err == nil && jwtExpiresWithin(jwt, jwtRenewBefore)) {
+		if err := withContext(ctx, s.renew); err != nil {
+			return jwt, fmt.Errorf("failed to fetch a new JWT with the client credentials: %s", err)
+		}
+		return s.get(ctx)
+	}
+	return jwt, err
+}
+
+func (s *jwtServiceOp) get(ctx context.Context) (string, error) {
+	var jwt string
+	err := withContext(ctx, func() (err error) {
+		jwt, err = s.client.load().JWT.Get()
+		return err
+	})
+	if ctx.Err() != nil {
+		return "", err
+	}
+	// The SDK returns the JWT along with the error if it expired
+	return jwt, err
+}
+
+// renew fetches a new JWT with the client credentials by creating a new
+// client, unless another caller renewed it in the meantime
+func (s *jwtServiceOp) renew() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if jwt, err := s.client.load().JWT.Get(); err == nil && !jwtExpiresWithin(jwt, jwtRenewBefore) {
+		return nil
+	}
+	client, err := s.newClient(&s.config)
+	if err != nil {
+		return err
+	}
+	s.client.set(client)
+	return nil
+}
+
+// Set replaces the JWT. The SDK can't change the JWT of a client, so a new
+// client is created, which validates the JWT without calling the API.
+func (s *jwtServiceOp) Set(jwt string) error {
+	config := s.config
+	config.JWT = jwt
+	client, err := s.newClient(&config)
+	if err != nil {
+		return err
+	}
+	s.client.set(client)
+	return nil
+}
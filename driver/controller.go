@@ -19,9 +19,9 @@ package driver
 import (
 	"context"
 	"fmt"
+	"math"
 	"strconv"
 	"strings"
-	"sync"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
@@ -57,12 +57,19 @@ const (
 	// the size they provided did not satisfy our requirements
 	defaultVolumeSizeInBytes int64 = 10 * GiB
 
-	// diskType is used to specify the type of disk to be used in the G8
-	diskType = "D"
-)
+	// unlimitedCapacity is reported as available capacity when no disk
+	// quota is set on the account or cloudspace
+	unlimitedCapacity int64 = math.MaxInt64
+
+	// defaultDiskType is the type of disk used in the G8 when the
+	// StorageClass doesn't specify one
+	defaultDiskType = "D"
 
-// Mutex to serialize volume cleanup
-var serializeVolumeDeletes sync.Mutex
+	// publishInfoPCIBus and publishInfoPCISlot hold the PCI address of the
+	// disk on the machine it is published on in the publish context
+	publishInfoPCIBus  = "PublishInfoPCIBus"
+	publishInfoPCISlot = "PublishInfoPCISlot"
+)
 
 // CreateVolume creates a new volume from the given request. The function is
 // idempotent.
@@ -75,58 +82,119 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume Volume capabilities must be provided")
 	}
 
+	// Disks can't be restored from snapshots nor cloned through the OVC API
+	if req.GetVolumeContentSource() != nil {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolume Volume content source is not supported")
+	}
+
 	size, err := extractStorage(req.CapacityRange)
 	if err != nil {
 		return nil, status.Errorf(codes.OutOfRange, "invalid capacity range: %v", err)
 	}
 
+	params, err := parseVolumeParameters(req.Parameters)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid parameters: %v", err)
+	}
+
+	var volumeContext map[string]string
+	if params.fsType != "" {
+		volumeContext = map[string]string{
+			parameterFsType: params.fsType,
+		}
+	}
+
+	t, err := d.tenant(ctx, req.Secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	requirements := req.GetAccessibilityRequirements()
+	location := d.pickLocation(requirements)
+	if location == nil && len(requirements.GetPreferred()) == 0 && len(requirements.GetRequisite()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "CreateVolume Accessibility requirements must be provided to choose one of the locations of the G8")
+	}
+	if location == nil {
+		return nil, status.Error(codes.ResourceExhausted, "CreateVolume Accessibility requirements can not be satisfied by any location")
+	}
+	var accessibleTopology []*csi.Topology
+	if location.Code != "" {
+		accessibleTopology = []*csi.Topology{locationTopology(*location)}
+	}
+
 	// get volume first, if it's created do no thing
 	volumeName := req.Name
-	volumes, err := d.client.Disks.List(d.accountID, diskType)
+	volumes, err := t.listVolumes(ctx)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, apiError(err)
 	}
 
-	// volume already exist, do nothing
-	for _, vol := range *volumes {
-		if vol.Name == req.Name {
-			d.log.Debug("Volume was already created")
-			return &csi.CreateVolumeResponse{
-				Volume: &csi.Volume{
-					VolumeId:      strconv.Itoa(vol.ID),
-					CapacityBytes: int64(vol.Size) * GiB,
-				},
-			}, nil
+	// volume already exist, do nothing if it was created by the driver for
+	// the same request
+	metadata := newDiskMetadata(req, params, d.clusterID)
+	vol, err := findCreatedVolume(volumes, req.Name, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if vol != nil {
+		volSize := int64(vol.Size) * GiB
+		if volSize < req.CapacityRange.GetRequiredBytes() || (req.CapacityRange.GetLimitBytes() > 0 && volSize > req.CapacityRange.GetLimitBytes()) {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s already exists with an incompatible size of %v", req.Name, formatBytes(volSize))
+		}
+		// The disk lives in the location it was created in, which isn't
+		// necessarily the one picked for this request
+		disk, err := t.client.Disks.Get(ctx, vol.ID)
+		if err != nil {
+			return nil, apiError(err)
+		}
+		var existingTopology []*csi.Topology
+		if existing := d.locationByGridID(disk.GridID); existing != nil && existing.Code != "" {
+			existingTopology = []*csi.Topology{locationTopology(*existing)}
 		}
+		d.log.Debug("Volume was already created")
+		return &csi.CreateVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:           strconv.Itoa(vol.ID),
+				CapacityBytes:      volSize,
+				VolumeContext:      volumeContext,
+				AccessibleTopology: existingTopology,
+			},
+		}, nil
 	}
 
 	diskConfig := &ovc.DiskConfig{
 		Name:        volumeName,
-		Description: createdByGig,
+		Description: metadata.description(),
 		Size:        int(size / GiB),
-		AccountID:   d.accountID,
-		GridID:      d.gridID,
-		Type:        diskType,
+		AccountID:   t.accountID,
+		GridID:      location.GridID,
+		Type:        params.diskType,
+		IOPS:        params.iops,
+		SSDSize:     params.ssdSize,
 	}
 
 	ll := d.log.WithFields(logrus.Fields{
 		"volume_name":             volumeName,
+		"account_id":              t.accountID,
 		"storage_size_giga_bytes": size / GiB,
 		"method":                  "create_volume",
 		"volume_capabilities":     req.VolumeCapabilities,
+		"parameters":              req.Parameters,
 	})
 	ll.Debug("Create volume called")
 
 	ll.WithField("volume_req", diskConfig).Debug("Creating volume")
-	volID, err := d.client.Disks.Create(diskConfig)
+	volID, err := t.client.Disks.Create(ctx, diskConfig)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, t.createError(ctx, err, size)
 	}
 
 	resp := &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      strconv.Itoa(volID),
-			CapacityBytes: size,
+			VolumeId:           strconv.Itoa(volID),
+			CapacityBytes:      size,
+			VolumeContext:      volumeContext,
+			AccessibleTopology: accessibleTopology,
 		},
 	}
 
@@ -135,6 +203,36 @@ func (d *Driver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest)
 	return resp, nil
 }
 
+// findCreatedVolume returns the volume with the given name that was created
+// by the driver, or nil if there is none. Disk names aren't unique, so disks
+// that weren't created by the driver or were created for another cluster are
+// skipped. An error is returned if a volume with the name was created for
+// another request.
+func findCreatedVolume(volumes []ovc.Disk, name string, metadata *diskMetadata) (*ovc.Disk, error) {
+	var conflict error
+	for i, vol := range volumes {
+		if vol.Name != name {
+			continue
+		}
+		owned, existing := parseDiskDescription(vol.Description)
+		if !owned {
+			continue
+		}
+		// Disks created before the metadata was stored are adopted
+		if existing != nil {
+			if existing.Cluster != "" && metadata.Cluster != "" && existing.Cluster != metadata.Cluster {
+				continue
+			}
+			if err := existing.matches(metadata); err != nil {
+				conflict = status.Errorf(codes.AlreadyExists, "volume %s already exists as disk %d, but %s", name, vol.ID, err)
+				continue
+			}
+		}
+		return &volumes[i], nil
+	}
+	return nil, conflict
+}
+
 // DeleteVolume deletes the given volume.
 func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
 	if req.VolumeId == "" {
@@ -148,6 +246,12 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 	ll.Debug("Delete volume called")
 
 	volID, err := strconv.Atoi(req.VolumeId)
+	if err != nil {
+		ll.Debug("Volume ID is not a disk ID, nothing to delete")
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	t, err := d.tenant(ctx, req.Secrets)
 	if err != nil {
 		return nil, err
 	}
@@ -158,13 +262,21 @@ func (d *Driver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest)
 		Permanently: true,
 	}
 
-	// Serialize deleting disks
-	serializeVolumeDeletes.Lock()
-	defer serializeVolumeDeletes.Unlock()
-	err = d.client.Disks.Delete(deleteConfig)
+	// Don't delete a disk while it is being attached or detached
+	unlock := t.attacher.lockDisk(volID)
+	defer unlock()
+	err = t.client.Disks.Delete(ctx, deleteConfig)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, err.Error())
+		// The error doesn't tell whether the disk is missing or the machine
+		// it is detached from, only a disk that is no longer listed is
+		// already deleted
+		listed, listErr := t.diskListed(ctx, volID)
+		if listErr != nil || listed {
+			return nil, apiError(err)
+		}
+		ll.Debug("Volume was already deleted")
 	}
+	t.attacher.forget(volID)
 
 	ll.Debug("Volume is deleted")
 
@@ -197,36 +309,44 @@ func (d *Driver) ControllerPublishVolume(ctx context.Context, req *csi.Controlle
 	logger.Debug("Controller publish volume called")
 
 	diskID, err := strconv.Atoi(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Volume not found")
+	}
+	t, err := d.tenant(ctx, req.Secrets)
 	if err != nil {
 		return nil, err
 	}
+	if _, err := t.getVolume(ctx, diskID); err != nil {
+		return nil, err
+	}
 
 	machineID, err := strconv.Atoi(req.NodeId)
 	if err != nil {
-		return nil, err
+		return nil, status.Error(codes.NotFound, "Node not found")
 	}
 
-	ac := attachConfig{
-		machineID: machineID,
-		diskID:    diskID,
-		result:    make(chan error),
+	if err := t.attacher.attach(ctx, diskID, machineID); err != nil {
+		return nil, apiError(err)
 	}
 
-	d.attach <- ac
-	result := <-ac.result
-	close(ac.result)
-	if result == nil {
-		return controllerPublishVolumeSuccessResponse(fmt.Sprintf("disk-%d", diskID), req.NodeId, diskID), nil
+	// The PCI address of the disk is only known once it is attached. The node
+	// finds the device of the disk with it, as the disk may be in an account
+	// the node has no credentials for.
+	disk, err := t.client.Disks.Get(ctx, diskID)
+	if err != nil {
+		return nil, apiError(err)
 	}
-	return nil, result
+	return controllerPublishVolumeSuccessResponse(fmt.Sprintf("disk-%d", diskID), req.NodeId, disk), nil
 }
 
-func controllerPublishVolumeSuccessResponse(volumeName, nodeID string, volumeID int) *csi.ControllerPublishVolumeResponse {
+func controllerPublishVolumeSuccessResponse(volumeName, nodeID string, disk *ovc.DiskInfo) *csi.ControllerPublishVolumeResponse {
 	return &csi.ControllerPublishVolumeResponse{
 		PublishContext: map[string]string{
 			"PublishInfoVolumeName": volumeName,
-			"PublishInfoVolumeID":   strconv.Itoa(volumeID),
+			"PublishInfoVolumeID":   strconv.Itoa(disk.ID),
 			"PublishInfoNodeID":     nodeID,
+			publishInfoPCIBus:       strconv.Itoa(disk.PCIBus),
+			publishInfoPCISlot:      strconv.Itoa(disk.PCISlot),
 		},
 	}
 }
@@ -255,17 +375,14 @@ func (d *Driver) ControllerUnpublishVolume(ctx context.Context, req *csi.Control
 	})
 	ll.Debug("Controller unpublish volume called")
 
-	diskConfig := attachConfig{
-		machineID: machineID,
-		diskID:    volID,
-		result:    make(chan error),
+	t, err := d.tenant(ctx, req.Secrets)
+	if err != nil {
+		return nil, err
 	}
-	d.detach <- diskConfig
-	result := <-diskConfig.result
-	if result == nil {
-		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	if err := t.attacher.detach(ctx, volID, machineID); err != nil {
+		return nil, apiError(err)
 	}
-	return nil, result
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
 // ValidateVolumeCapabilities checks whether the volume capabilities requested
@@ -288,11 +405,15 @@ func (d *Driver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Valida
 	ll.Debug("Validate volume capabilities called")
 
 	diskID, err := strconv.Atoi(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Volume not found")
+	}
+	t, err := d.tenant(ctx, req.Secrets)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := d.client.Disks.Get(diskID); err != nil {
-		return nil, status.Error(codes.NotFound, "Volume not found")
+	if _, err := t.getVolume(ctx, diskID); err != nil {
+		return nil, err
 	}
 
 	volCaps := req.GetVolumeCapabilities()
@@ -319,18 +440,18 @@ func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 	})
 	ll.Debug("List volumes called")
 
-	disks, err := d.client.Disks.List(d.accountID, diskType)
+	disks, err := d.defaultTenant().listVolumes(ctx)
 	if err != nil {
-		return nil, err
+		return nil, apiError(err)
 	}
 
 	var entries []*csi.ListVolumesResponse_Entry
-	for _, disk := range *disks {
+	for _, disk := range disks {
 		diskID := strconv.Itoa(disk.ID)
 		entries = append(entries, &csi.ListVolumesResponse_Entry{
 			Volume: &csi.Volume{
 				VolumeId:      diskID,
-				CapacityBytes: int64(disk.Size),
+				CapacityBytes: int64(disk.Size) * GiB,
 			},
 		})
 	}
@@ -344,26 +465,190 @@ func (d *Driver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (
 	return resp, nil
 }
 
-// GetCapacity returns the capacity of the storage pool
+// GetCapacity returns the disk capacity that is left within the resource
+// limits of the account, and of its cloudspaces in the requested topology
 func (d *Driver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	// TODO: not able to return capacity of the storage pool
-	d.log.WithFields(logrus.Fields{
-		"params": req.Parameters,
-		"method": "get_capacity",
-	}).Warn("get capacity is not implemented")
+	ll := d.log.WithFields(logrus.Fields{
+		"params":   req.Parameters,
+		"topology": req.AccessibleTopology,
+		"method":   "get_capacity",
+	})
+	ll.Debug("Get capacity called")
 
-	return nil, status.Error(codes.Unimplemented, "")
+	if _, err := parseVolumeParameters(req.Parameters); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid parameters: %v", err)
+	}
+
+	var location *ovc.LocationInfo
+	if req.AccessibleTopology != nil {
+		location = d.locationByTopology(req.AccessibleTopology)
+		if location == nil {
+			ll.Debug("Topology does not match any location")
+			return &csi.GetCapacityResponse{}, nil
+		}
+	}
+
+	account, err := d.client.Accounts.Get(ctx, d.accountID)
+	if err != nil {
+		return nil, apiError(err)
+	}
+
+	disks, err := d.client.Disks.List(ctx, d.accountID, "")
+	if err != nil {
+		return nil, apiError(err)
+	}
+
+	available := remainingCapacity(account.ResourceLimits.CUD, *disks)
+
+	// A volume can be attached to the VMs of any cloudspace of the account in
+	// the location, it fits if one of them has room for it
+	remaining, err := d.cloudspaceCapacity(ctx, location, *disks)
+	if err != nil {
+		return nil, apiError(err)
+	}
+	if remaining < available {
+		available = remaining
+	}
+
+	ll.WithField("available_capacity", available).Debug("Capacity calculated")
+
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: available,
+	}, nil
+}
+
+// cloudspaceCapacity returns the largest capacity in bytes that is left
+// within the resource limits of a cloudspace of the account in the given
+// location, or in any location if it is nil. The disks of a cloudspace are
+// the disks attached to its machines. The capacity is unlimited if the
+// account has no cloudspace in the location.
+func (d *Driver) cloudspaceCapacity(ctx context.Context, location *ovc.LocationInfo, disks []ovc.Disk) (int64, error) {
+	cloudspaces, err := d.client.CloudSpaces.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var largest int64
+	found := false
+	for _, info := range *cloudspaces {
+		if info.AccountID != d.accountID || (location != nil && info.GridID != location.GridID) {
+			continue
+		}
+
+		cloudspace, err := d.client.CloudSpaces.Get(ctx, info.ID)
+		if err != nil {
+			return 0, err
+		}
+		machines, err := d.client.Machines.List(ctx, info.ID)
+		if err != nil {
+			return 0, err
+		}
+
+		cloudspaceDiskIDs := make(map[int]bool)
+		for _, machine := range *machines {
+			for _, diskID := range machine.Disks {
+				cloudspaceDiskIDs[diskID] = true
+			}
+		}
+
+		var cloudspaceDisks []ovc.Disk
+		for _, disk := range disks {
+			if cloudspaceDiskIDs[disk.ID] {
+				cloudspaceDisks = append(cloudspaceDisks, disk)
+			}
+		}
+
+		if remaining := remainingCapacity(cloudspace.ResourceLimits.CUD, cloudspaceDisks); !found || remaining > largest {
+			largest = remaining
+		}
+		found = true
+	}
+
+	if !found {
+		return unlimitedCapacity, nil
+	}
+	return largest, nil
+}
+
+// remainingCapacity returns the capacity in bytes that is left of the given
+// disk quota in GiB after subtracting the size of the given disks. A negative
+// quota means there is no limit.
+func remainingCapacity(quotaGiB int, disks []ovc.Disk) int64 {
+	if quotaGiB < 0 {
+		return unlimitedCapacity
+	}
+
+	used := 0
+	for _, disk := range disks {
+		used += disk.Size
+	}
+
+	if used >= quotaGiB {
+		return 0
+	}
+
+	return int64(quotaGiB-used) * GiB
 }
 
 // ControllerExpandVolume expands the volume.
 func (d *Driver) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	// TODO: no resize support
-	d.log.WithFields(logrus.Fields{
-		"volume_id": req.VolumeId,
-		"method":    "resize_volume",
-	}).Warn("ControllerExpandVolume is not implemented")
+	if req.VolumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume Volume ID must be provided")
+	}
 
-	return nil, status.Error(codes.Unimplemented, "")
+	if req.CapacityRange == nil {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume Capacity range must be provided")
+	}
+
+	size, err := extractStorage(req.CapacityRange)
+	if err != nil {
+		return nil, status.Errorf(codes.OutOfRange, "invalid capacity range: %v", err)
+	}
+
+	ll := d.log.WithFields(logrus.Fields{
+		"volume_id":               req.VolumeId,
+		"storage_size_giga_bytes": size / GiB,
+		"method":                  "controller_expand_volume",
+	})
+	ll.Debug("Controller expand volume called")
+
+	diskID, err := strconv.Atoi(req.VolumeId)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, "Volume not found")
+	}
+	t, err := d.tenant(ctx, req.Secrets)
+	if err != nil {
+		return nil, err
+	}
+	disk, err := t.getVolume(ctx, diskID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The G8 sizes disks in whole GiB, round up so the requested size is met
+	sizeGiB := int((size + GiB - 1) / GiB)
+	if disk.SizeMax >= sizeGiB {
+		ll.WithField("current_size_giga_bytes", disk.SizeMax).Debug("Volume is already large enough")
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         int64(disk.SizeMax) * GiB,
+			NodeExpansionRequired: true,
+		}, nil
+	}
+
+	err = t.client.Disks.Resize(ctx, &ovc.DiskConfig{
+		DiskID: diskID,
+		Size:   sizeGiB,
+	})
+	if err != nil {
+		return nil, apiError(err)
+	}
+
+	ll.Debug("Volume is expanded")
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         int64(sizeGiB) * GiB,
+		NodeExpansionRequired: true,
+	}, nil
 }
 
 // CreateSnapshot creates a snaphot of the volume
@@ -424,6 +709,82 @@ func (d *Driver) ControllerGetCapabilities(ctx context.Context, req *csi.Control
 	return &csi.ControllerGetCapabilitiesResponse{Capabilities: caps}, nil
 }
 
+// listVolumes returns the disks of the account that can be used as a volume,
+// which are the disks of any type except for boot disks and cdroms
+func (t *tenant) listVolumes(ctx context.Context) ([]ovc.Disk, error) {
+	disks, err := t.client.Disks.List(ctx, t.accountID, "")
+	if err != nil {
+		return nil, err
+	}
+
+	var volumes []ovc.Disk
+	for _, disk := range *disks {
+		if disk.Type == bootDiskType || disk.Type == cdromDiskType {
+			continue
+		}
+		volumes = append(volumes, disk)
+	}
+
+	return volumes, nil
+}
+
+// getVolume returns the disk of a volume, or a NotFound error if the account
+// has no such disk. The OVC SDK returns the response body as error when the
+// API can't find a disk, which doesn't tell a missing disk apart from other
+// failures, so a disk is only considered missing if it isn't listed either.
+func (t *tenant) getVolume(ctx context.Context, diskID int) (*ovc.DiskInfo, error) {
+	disk, err := t.client.Disks.Get(ctx, diskID)
+	switch errorCode(err) {
+	case codes.OK:
+		return disk, nil
+	case codes.NotFound:
+		return nil, status.Error(codes.NotFound, "Volume not found")
+	case codes.Internal:
+		listed, listErr := t.diskListed(ctx, diskID)
+		if listErr == nil && !listed {
+			return nil, status.Error(codes.NotFound, "Volume not found")
+		}
+	}
+	return nil, apiError(err)
+}
+
+// diskListed reports whether the given disk is one of the disks of the
+// account
+func (t *tenant) diskListed(ctx context.Context, diskID int) (bool, error) {
+	disks, err := t.client.Disks.List(ctx, t.accountID, "")
+	if err != nil {
+		return false, err
+	}
+	for _, disk := range *disks {
+		if disk.ID == diskID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// createError returns the error to return for a disk that failed to be
+// created. The OVC SDK doesn't tell why a call failed, so the disk quota of
+// the account is checked to report a disk that doesn't fit in it as
+// ResourceExhausted.
+func (t *tenant) createError(ctx context.Context, err error, size int64) error {
+	if errorCode(err) != codes.Internal {
+		return apiError(err)
+	}
+	account, accountErr := t.client.Accounts.Get(ctx, t.accountID)
+	if accountErr != nil {
+		return apiError(err)
+	}
+	disks, listErr := t.client.Disks.List(ctx, t.accountID, "")
+	if listErr != nil {
+		return apiError(err)
+	}
+	if remainingCapacity(account.ResourceLimits.CUD, *disks) < size {
+		return status.Errorf(codes.ResourceExhausted, "volume of %v exceeds the disk quota of the account: %v", formatBytes(size), err)
+	}
+	return apiError(err)
+}
+
 // extractStorage extracts the storage size in bytes from the given capacity
 // range. If the capacity range is not satisfied it returns the default volume
 // size. If the capacity range is below or above supported sizes, it returns an
@@ -506,6 +867,10 @@ func formatBytes(inputBytes int64) string {
 
 func (d *Driver) isValidVolumeCapabilities(volCaps []*csi.VolumeCapability) bool {
 	hasSupport := func(cap *csi.VolumeCapability) bool {
+		// Volumes can be used as a raw block device or with a filesystem
+		if cap.GetBlock() == nil && cap.GetMount() == nil {
+			return false
+		}
 		for _, c := range d.volumeCaps {
 			if c.GetMode() == cap.AccessMode.GetMode() {
 				return true
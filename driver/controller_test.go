@@ -0,0 +1,722 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// newTestDriver returns a controller driver backed by the given fake
+func newTestDriver(t *testing.T, f *fakeOVC) *Driver {
+	d, err := newDriver(&Config{
+		Account: fakeAccountName,
+		Mode:    ControllerMode,
+	}, f.client())
+	require.NoError(t, err)
+	t.Cleanup(d.Stop)
+	return d
+}
+
+func mountCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+}
+
+func TestCreateVolume(t *testing.T) {
+	tt := []struct {
+		name    string
+		setup   func(f *fakeOVC, req *csi.CreateVolumeRequest)
+		code    codes.Code
+		sizeGiB int
+	}{
+		{
+			name:    "default size",
+			setup:   func(f *fakeOVC, req *csi.CreateVolumeRequest) {},
+			code:    codes.OK,
+			sizeGiB: 10,
+		},
+		{
+			name: "requested size",
+			setup: func(f *fakeOVC, req *csi.CreateVolumeRequest) {
+				req.CapacityRange = &csi.CapacityRange{RequiredBytes: 5 * GiB}
+			},
+			code:    codes.OK,
+			sizeGiB: 5,
+		},
+		{
+			name: "missing name",
+			setup: func(f *fakeOVC, req *csi.CreateVolumeRequest) {
+				req.Name = ""
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "missing capabilities",
+			setup: func(f *fakeOVC, req *csi.CreateVolumeRequest) {
+				req.VolumeCapabilities = nil
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "unknown parameter",
+			setup: func(f *fakeOVC, req *csi.CreateVolumeRequest) {
+				req.Parameters = map[string]string{"foo": "bar"}
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "existing volume",
+			setup: func(f *fakeOVC, req *csi.CreateVolumeRequest) {
+				diskID := f.addDisk(f.accountID(), req.Name, 3)
+				f.setDiskDescription(diskID, createdByGig)
+			},
+			code:    codes.OK,
+			sizeGiB: 3,
+		},
+		{
+			name: "existing volume with different size",
+			setup: func(f *fakeOVC, req *csi.CreateVolumeRequest) {
+				diskID := f.addDisk(f.accountID(), req.Name, 3)
+				f.setDiskDescription(diskID, createdByGig)
+				req.CapacityRange = &csi.CapacityRange{RequiredBytes: 5 * GiB}
+			},
+			code: codes.AlreadyExists,
+		},
+		{
+			name: "existing disk not created by the driver",
+			setup: func(f *fakeOVC, req *csi.CreateVolumeRequest) {
+				f.addDisk(f.accountID(), req.Name, 3)
+			},
+			code:    codes.OK,
+			sizeGiB: 10,
+		},
+
+		{
+			name: "existing volume with different parameters",
+			setup: func(f *fakeOVC, req *csi.CreateVolumeRequest) {
+				diskID := f.addDisk(f.accountID(), req.Name, 10)
+				params, err := parseVolumeParameters(map[string]string{parameterIOPS: "1000"})
+				require.NoError(t, err)
+				f.setDiskDescription(diskID, newDiskMetadata(req, params, "").description())
+			},
+			code: codes.AlreadyExists,
+		},
+		{
+			name: "existing volume of another PersistentVolume",
+			setup: func(f *fakeOVC, req *csi.CreateVolumeRequest) {
+				diskID := f.addDisk(f.accountID(), req.Name, 10)
+				params, err := parseVolumeParameters(nil)
+				require.NoError(t, err)
+				other := *req
+				other.Parameters = map[string]string{parameterPVName: "pv-2"}
+				f.setDiskDescription(diskID, newDiskMetadata(&other, params, "").description())
+			},
+			code: codes.AlreadyExists,
+		},
+		{
+			name: "quota exceeded",
+			setup: func(f *fakeOVC, req *csi.CreateVolumeRequest) {
+				f.setAccountQuota(f.accountID(), 5)
+			},
+			code: codes.ResourceExhausted,
+		},
+		{
+			name: "create fails",
+			setup: func(f *fakeOVC, req *csi.CreateVolumeRequest) {
+				f.failOn("Disks.Create", errors.New("boom"))
+			},
+			code: codes.Internal,
+		},
+		{
+			name: "unsatisfiable topology",
+			setup: func(f *fakeOVC, req *csi.CreateVolumeRequest) {
+				req.AccessibilityRequirements = &csi.TopologyRequirement{
+					Requisite: []*csi.Topology{{Segments: map[string]string{topologyKeyLocation: "nowhere"}}},
+				}
+			},
+			code: codes.ResourceExhausted,
+		},
+		{
+			name: "from volume",
+			setup: func(f *fakeOVC, req *csi.CreateVolumeRequest) {
+				diskID := f.addDisk(f.accountID(), "source", 20)
+				req.VolumeContentSource = &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Volume{
+						Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: strconv.Itoa(diskID)},
+					},
+				}
+			},
+			code: codes.InvalidArgument,
+		},
+		{
+			name: "from snapshot",
+			setup: func(f *fakeOVC, req *csi.CreateVolumeRequest) {
+				req.VolumeContentSource = &csi.VolumeContentSource{
+					Type: &csi.VolumeContentSource_Snapshot{
+						Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "1-2"},
+					},
+				}
+			},
+			code: codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			d := newTestDriver(t, f)
+			req := &csi.CreateVolumeRequest{
+				Name:               "pvc-1",
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+			}
+			tc.setup(f, req)
+
+			resp, err := d.CreateVolume(context.Background(), req)
+			require.Equal(t, tc.code, status.Code(err), "unexpected error: %v", err)
+			if tc.code != codes.OK {
+				return
+			}
+
+			diskID, err := strconv.Atoi(resp.Volume.VolumeId)
+			require.NoError(t, err)
+			disk := f.disk(diskID)
+			require.NotNil(t, disk)
+			require.Equal(t, req.Name, disk.Name)
+			require.Equal(t, tc.sizeGiB, disk.SizeMax)
+			require.Equal(t, int64(tc.sizeGiB)*GiB, resp.Volume.CapacityBytes)
+		})
+	}
+}
+
+func TestCreateVolumeIdempotent(t *testing.T) {
+	f := newFakeOVC()
+	d := newTestDriver(t, f)
+	req := &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+	}
+
+	first, err := d.CreateVolume(context.Background(), req)
+	require.NoError(t, err)
+	second, err := d.CreateVolume(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, first.Volume.VolumeId, second.Volume.VolumeId)
+	require.Equal(t, 1, f.callCount("Disks.Create"))
+
+	diskID, err := strconv.Atoi(first.Volume.VolumeId)
+	require.NoError(t, err)
+	owned, metadata := parseDiskDescription(f.disk(diskID).Descr)
+	require.True(t, owned)
+	require.Equal(t, req.Name, metadata.PVName)
+}
+
+func TestFindCreatedVolume(t *testing.T) {
+	req := &csi.CreateVolumeRequest{Name: "pvc-1"}
+	params, err := parseVolumeParameters(nil)
+	require.NoError(t, err)
+	metadata := newDiskMetadata(req, params, "cluster-1")
+	otherCluster := newDiskMetadata(req, params, "cluster-2")
+	otherParams, err := parseVolumeParameters(map[string]string{parameterIOPS: "1000"})
+	require.NoError(t, err)
+	conflicting := newDiskMetadata(req, otherParams, "cluster-1")
+
+	tt := []struct {
+		name   string
+		disks  []ovc.Disk
+		diskID int
+		code   codes.Code
+	}{
+		{
+			name: "skips disks not created by the driver",
+			disks: []ovc.Disk{
+				{ID: 1, Name: req.Name},
+				{ID: 2, Name: req.Name, Description: metadata.description()},
+			},
+			diskID: 2,
+		},
+		{
+			name: "skips disks of other clusters",
+			disks: []ovc.Disk{
+				{ID: 1, Name: req.Name, Description: otherCluster.description()},
+			},
+		},
+		{
+			name: "adopts disks without metadata",
+			disks: []ovc.Disk{
+				{ID: 1, Name: req.Name, Description: createdByGig},
+			},
+			diskID: 1,
+		},
+		{
+			name: "conflicting request",
+			disks: []ovc.Disk{
+				{ID: 1, Name: req.Name, Description: conflicting.description()},
+			},
+			code: codes.AlreadyExists,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			vol, err := findCreatedVolume(tc.disks, req.Name, metadata)
+			require.Equal(t, tc.code, status.Code(err), "%v", err)
+			if tc.diskID == 0 {
+				require.Nil(t, vol)
+			} else {
+				require.Equal(t, tc.diskID, vol.ID)
+			}
+		})
+	}
+}
+
+func TestCreateVolumeIdempotentTopology(t *testing.T) {
+	f := newFakeOVC()
+	f.locations = append(f.locations, ovc.LocationInfo{GridID: fakeGridID + 1, Code: "be-test-2"})
+	d := newTestDriver(t, f)
+	req := &csi.CreateVolumeRequest{
+		Name:               "pvc-1",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Preferred: []*csi.Topology{{Segments: map[string]string{topologyKeyLocation: "be-test-2"}}},
+		},
+	}
+	first, err := d.CreateVolume(context.Background(), req)
+	require.NoError(t, err)
+
+	// A retry that prefers another location reports the location of the disk
+	req.AccessibilityRequirements.Preferred = []*csi.Topology{{Segments: map[string]string{topologyKeyLocation: fakeLocation}}}
+	second, err := d.CreateVolume(context.Background(), req)
+	require.NoError(t, err)
+	require.Equal(t, first.Volume.VolumeId, second.Volume.VolumeId)
+	require.Equal(t, first.Volume.AccessibleTopology, second.Volume.AccessibleTopology)
+	require.Equal(t, "be-test-2", second.Volume.AccessibleTopology[0].Segments[topologyKeyLocation])
+}
+
+func TestDeleteVolume(t *testing.T) {
+	tt := []struct {
+		name     string
+		attached bool
+		// missing deletes a disk that doesn't exist
+		missing  bool
+		failure  error
+		volumeID func(diskID int) string
+		code     codes.Code
+	}{
+		{
+			name:     "detached volume",
+			volumeID: strconv.Itoa,
+			code:     codes.OK,
+		},
+		{
+			name:     "attached volume",
+			attached: true,
+			volumeID: strconv.Itoa,
+			code:     codes.OK,
+		},
+		{
+			name:     "missing volume ID",
+			volumeID: func(int) string { return "" },
+			code:     codes.InvalidArgument,
+		},
+		{
+			name:     "already deleted",
+			missing:  true,
+			volumeID: strconv.Itoa,
+			code:     codes.OK,
+		},
+		{
+			name:     "delete fails",
+			failure:  errors.New("boom"),
+			volumeID: strconv.Itoa,
+			code:     codes.Internal,
+		},
+		{
+			name:     "machine not found",
+			attached: true,
+			failure:  errNotFound("machine", "of the disk"),
+			volumeID: strconv.Itoa,
+			code:     codes.Internal,
+		},
+		{
+			name:     "API unavailable",
+			failure:  errGateway("502 Bad Gateway"),
+			volumeID: strconv.Itoa,
+			code:     codes.Unavailable,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+			machineID := f.addMachine(cloudspaceID)
+			diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+			if tc.attached {
+				f.attachDisk(diskID, machineID)
+			}
+			f.failOn("Disks.Delete", tc.failure)
+			d := newTestDriver(t, f)
+
+			deletedID := diskID
+			if tc.missing {
+				deletedID = f.nextID()
+			}
+			_, err := d.DeleteVolume(context.Background(), &csi.DeleteVolumeRequest{
+				VolumeId: tc.volumeID(deletedID),
+			})
+			require.Equal(t, tc.code, status.Code(err), "unexpected error: %v", err)
+			if tc.code == codes.OK && tc.failure == nil && !tc.missing {
+				require.Nil(t, f.disk(diskID))
+				require.Zero(t, f.attachedTo(diskID))
+			} else {
+				require.NotNil(t, f.disk(diskID))
+			}
+		})
+	}
+}
+
+func TestControllerPublishVolume(t *testing.T) {
+	tt := []struct {
+		name string
+		// attachedTo is the index of the machine the disk is attached to
+		// before publishing, or -1
+		attachedTo int
+		failure    error
+		attaches   int
+		pass       bool
+	}{
+		{
+			name:       "detached volume",
+			attachedTo: -1,
+			attaches:   1,
+			pass:       true,
+		},
+		{
+			name:       "already attached",
+			attachedTo: 0,
+			attaches:   0,
+			pass:       true,
+		},
+		{
+			name:       "attached to other machine",
+			attachedTo: 1,
+			attaches:   1,
+			pass:       true,
+		},
+		{
+			name:       "attach fails",
+			attachedTo: -1,
+			failure:    errors.New("boom"),
+			attaches:   1,
+			pass:       false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+			machines := []int{f.addMachine(cloudspaceID), f.addMachine(cloudspaceID)}
+			diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+			if tc.attachedTo >= 0 {
+				f.attachDisk(diskID, machines[tc.attachedTo])
+			}
+			f.failOn("Disks.Attach", tc.failure)
+			d := newTestDriver(t, f)
+
+			resp, err := d.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+				VolumeId:         strconv.Itoa(diskID),
+				NodeId:           strconv.Itoa(machines[0]),
+				VolumeCapability: mountCapability(),
+			})
+			require.Equal(t, tc.attaches, f.callCount("Disks.Attach"))
+			if !tc.pass {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, strconv.Itoa(diskID), resp.PublishContext["PublishInfoVolumeID"])
+			require.Equal(t, machines[0], f.attachedTo(diskID))
+			// The node finds the device by the PCI address it is attached on
+			require.Equal(t, strconv.Itoa(f.disk(diskID).PCISlot), resp.PublishContext[publishInfoPCISlot])
+			require.Equal(t, "0", resp.PublishContext[publishInfoPCIBus])
+		})
+	}
+}
+
+func TestControllerPublishVolumeInvalidArguments(t *testing.T) {
+	d := newTestDriver(t, newFakeOVC())
+
+	tt := []*csi.ControllerPublishVolumeRequest{
+		{NodeId: "1", VolumeCapability: mountCapability()},
+		{VolumeId: "1", VolumeCapability: mountCapability()},
+		{VolumeId: "1", NodeId: "1"},
+	}
+
+	for _, req := range tt {
+		_, err := d.ControllerPublishVolume(context.Background(), req)
+		require.Equal(t, codes.InvalidArgument, status.Code(err))
+	}
+}
+
+func TestControllerPublishVolumeContext(t *testing.T) {
+	tt := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+		code codes.Code
+	}{
+		{
+			name: "deadline exceeded",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 10*time.Millisecond)
+			},
+			code: codes.DeadlineExceeded,
+		},
+		{
+			name: "canceled",
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				return ctx, cancel
+			},
+			code: codes.Canceled,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+			machineID := f.addMachine(cloudspaceID)
+			diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+			d := newTestDriver(t, f)
+			release := f.hold("Disks.Attach")
+			defer release()
+
+			ctx, cancel := tc.ctx()
+			defer cancel()
+			_, err := d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+				VolumeId:         strconv.Itoa(diskID),
+				NodeId:           strconv.Itoa(machineID),
+				VolumeCapability: mountCapability(),
+			})
+			require.Equal(t, tc.code, status.Code(err), "unexpected error: %v", err)
+		})
+	}
+}
+
+func TestControllerUnpublishVolume(t *testing.T) {
+	tt := []struct {
+		name     string
+		attached bool
+		failure  error
+		detaches int
+		pass     bool
+	}{
+		{
+			name:     "attached volume",
+			attached: true,
+			detaches: 1,
+			pass:     true,
+		},
+		{
+			name:     "detached volume",
+			detaches: 0,
+			pass:     true,
+		},
+		{
+			name:     "detach fails",
+			attached: true,
+			failure:  errors.New("boom"),
+			detaches: 1,
+			pass:     false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+			machineID := f.addMachine(cloudspaceID)
+			diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+			if tc.attached {
+				f.attachDisk(diskID, machineID)
+			}
+			f.failOn("Disks.Detach", tc.failure)
+			d := newTestDriver(t, f)
+
+			_, err := d.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{
+				VolumeId: strconv.Itoa(diskID),
+				NodeId:   strconv.Itoa(machineID),
+			})
+			require.Equal(t, tc.detaches, f.callCount("Disks.Detach"))
+			if !tc.pass {
+				require.Error(t, err)
+				require.Equal(t, machineID, f.attachedTo(diskID))
+				return
+			}
+			require.NoError(t, err)
+			require.Zero(t, f.attachedTo(diskID))
+		})
+	}
+}
+
+func TestControllerExpandVolume(t *testing.T) {
+	tt := []struct {
+		name     string
+		required int64
+		missing  bool
+		failure  error
+		code     codes.Code
+		sizeGiB  int
+	}{
+		{
+			name:     "grow",
+			required: 20 * GiB,
+			code:     codes.OK,
+			sizeGiB:  20,
+		},
+		{
+			name:     "round up to GiB",
+			required: 15*GiB + 1,
+			code:     codes.OK,
+			sizeGiB:  16,
+		},
+		{
+			name:     "already large enough",
+			required: 5 * GiB,
+			code:     codes.OK,
+			sizeGiB:  10,
+		},
+		{
+			name:     "missing volume",
+			required: 20 * GiB,
+			missing:  true,
+			code:     codes.NotFound,
+		},
+		{
+			name:     "lookup fails",
+			required: 20 * GiB,
+			failure:  errNotFound("account", "of the disk"),
+			code:     codes.Internal,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+			f.failOn("Disks.Get", tc.failure)
+			d := newTestDriver(t, f)
+
+			volumeID := strconv.Itoa(diskID)
+			if tc.missing {
+				volumeID = "1000"
+			}
+			resp, err := d.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+				VolumeId:      volumeID,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: tc.required},
+			})
+			require.Equal(t, tc.code, status.Code(err), "unexpected error: %v", err)
+			if tc.code != codes.OK {
+				return
+			}
+			require.True(t, resp.NodeExpansionRequired)
+			require.Equal(t, int64(tc.sizeGiB)*GiB, resp.CapacityBytes)
+			require.Equal(t, tc.sizeGiB, f.disk(diskID).SizeMax)
+		})
+	}
+}
+
+func TestGetCapacity(t *testing.T) {
+	tt := []struct {
+		name      string
+		quotaGiB  int
+		disksGiB  []int
+		available int64
+	}{
+		{
+			name:      "unlimited",
+			quotaGiB:  -1,
+			disksGiB:  []int{10},
+			available: math.MaxInt64,
+		},
+		{
+			name:      "partially used",
+			quotaGiB:  50,
+			disksGiB:  []int{10, 15},
+			available: 25 * GiB,
+		},
+		{
+			name:      "overcommitted",
+			quotaGiB:  10,
+			disksGiB:  []int{15},
+			available: 0,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			f.setAccountQuota(f.accountID(), tc.quotaGiB)
+			for i, size := range tc.disksGiB {
+				f.addDisk(f.accountID(), strconv.Itoa(i), size)
+			}
+			d := newTestDriver(t, f)
+
+			resp, err := d.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+			require.NoError(t, err)
+			require.Equal(t, tc.available, resp.AvailableCapacity)
+		})
+	}
+}
+
+func TestGetCapacityCloudSpaces(t *testing.T) {
+	f := newFakeOVC()
+	f.setAccountQuota(f.accountID(), 100)
+	full := f.addMachine(f.addCloudSpace(f.accountID(), 20))
+	f.attachDisk(f.addDisk(f.accountID(), "pvc-1", 15), full)
+	roomy := f.addMachine(f.addCloudSpace(f.accountID(), 40))
+	f.attachDisk(f.addDisk(f.accountID(), "pvc-2", 10), roomy)
+	// Cloudspaces of other accounts are ignored
+	f.addCloudSpace(f.addAccount(tenantAccountName, -1), 100)
+	d := newTestDriver(t, f)
+
+	resp, err := d.GetCapacity(context.Background(), &csi.GetCapacityRequest{
+		AccessibleTopology: locationTopology(ovc.LocationInfo{GridID: fakeGridID, Code: fakeLocation}),
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(30*GiB), resp.AvailableCapacity)
+
+	f.attachDisk(f.addDisk(f.accountID(), "pvc-3", 28), roomy)
+	resp, err = d.GetCapacity(context.Background(), &csi.GetCapacityRequest{})
+	require.NoError(t, err)
+	require.Equal(t, int64(5*GiB), resp.AvailableCapacity)
+}
+
+func TestListVolumes(t *testing.T) {
+	f := newFakeOVC()
+	diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+	d := newTestDriver(t, f)
+
+	resp, err := d.ListVolumes(context.Background(), &csi.ListVolumesRequest{})
+	require.NoError(t, err)
+	require.Len(t, resp.Entries, 1)
+	require.Equal(t, strconv.Itoa(diskID), resp.Entries[0].Volume.VolumeId)
+	require.Equal(t, int64(10)*GiB, resp.Entries[0].Volume.CapacityBytes)
+}
@@ -0,0 +1,44 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"net/http"
+)
+
+// debugHandler returns the handler of the debug endpoints
+func (d *Driver) debugHandler() http.Handler {
+	mux := http.NewServeMux()
+	if d.attacher != nil {
+		mux.Handle("/debug/inventory", d.attacher.inventory)
+	}
+	return mux
+}
+
+// serveDebug serves the debug endpoints in the background
+func (d *Driver) serveDebug() {
+	d.debugSrv = &http.Server{
+		Addr:    d.debugAddress,
+		Handler: d.debugHandler(),
+	}
+	d.log.Infof("Serving debug endpoints on address: %s", d.debugAddress)
+	go func() {
+		if err := d.debugSrv.ListenAndServe(); err != http.ErrServerClosed {
+			d.log.Errorf("Debug server failed: %s", err)
+		}
+	}()
+}
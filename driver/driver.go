@@ -20,37 +20,178 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
 	"github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/kubernetes/pkg/util/mount"
 )
 
-type attachConfig struct {
-	machineID int
-	diskID    int
-	result    chan error
+// Mode defines which CSI services the driver serves
+type Mode string
+
+const (
+	// ControllerMode serves the identity and controller services. Only run
+	// one controller: attaches, detaches and deletes of a disk are serialized
+	// within its process, which also runs the inventory of attached disks and
+	// the garbage collector.
+	ControllerMode Mode = "controller"
+	// NodeMode serves the identity and node services
+	NodeMode Mode = "node"
+	// AllMode serves the identity, controller and node services
+	AllMode Mode = "all"
+)
+
+// ParseMode returns the mode matching the given name
+func ParseMode(name string) (Mode, error) {
+	switch mode := Mode(name); mode {
+	case ControllerMode, NodeMode, AllMode:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid mode %q, supported modes are %s, %s and %s", name, ControllerMode, NodeMode, AllMode)
+}
+
+// servesController returns true if the controller service is served in this mode
+func (m Mode) servesController() bool {
+	return m == ControllerMode || m == AllMode
+}
+
+// servesNode returns true if the node service is served in this mode
+func (m Mode) servesNode() bool {
+	return m == NodeMode || m == AllMode
+}
+
+// AuthMode defines how the driver authenticates against the OVC API
+type AuthMode string
+
+const (
+	// JWTAuth authenticates with a JWT issued by itsyou.online
+	JWTAuth AuthMode = "jwt"
+	// ClientCredentialsAuth authenticates with the client ID and secret of
+	// an itsyou.online API key, a new JWT is fetched before the current one
+	// expires
+	ClientCredentialsAuth AuthMode = "client-credentials"
+)
+
+// ParseAuthMode returns the authentication mode matching the given name, an
+// empty name selects JWT authentication
+func ParseAuthMode(name string) (AuthMode, error) {
+	switch mode := AuthMode(name); mode {
+	case "":
+		return JWTAuth, nil
+	case JWTAuth, ClientCredentialsAuth:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid authentication mode %q, supported modes are %s and %s", name, JWTAuth, ClientCredentialsAuth)
+}
+
+// Config contains the configuration of the driver
+type Config struct {
+	URL      string
+	Endpoint string
+	Account  string
+	JWT      string
+	Verbose  bool
+	Mode     Mode
+	Mounter  *mount.SafeFormatAndMount
+	// JWTFile is the path of a file containing the JWT, like a mounted
+	// secret. It takes precedence over JWT and is reloaded when it changes.
+	JWTFile string
+	// AuthMode selects whether the JWT or the client credentials are used
+	// to authenticate, defaults to the JWT
+	AuthMode     AuthMode
+	ClientID     string
+	ClientSecret string
+	// HostRoot is the directory the device and DMI paths of the node are
+	// looked up in, defaults to /
+	HostRoot string
+	// InventoryResync is the interval at which the inventory of attached
+	// disks is reconciled with the OVC API, defaults to 5 minutes
+	InventoryResync time.Duration
+	// DebugAddress is the address debug endpoints are served on, they are
+	// disabled if empty
+	DebugAddress string
+	// MetricsAddress is the address Prometheus metrics are served on, they
+	// are disabled if empty
+	MetricsAddress string
+	// HealthAddress is the address the /healthz endpoint is served on, it
+	// is disabled if empty
+	HealthAddress string
+	// ShutdownTimeout is how long Stop waits for running RPCs and queued
+	// attaches and detaches to finish, defaults to 25 seconds
+	ShutdownTimeout time.Duration
+	// RecoveryGracePeriod is how long a machine has to be halted or in
+	// error before its disks are detached from it when they are published
+	// on another node. Recovery is disabled if it is 0.
+	RecoveryGracePeriod time.Duration
+	// RecoveryStopMachine force stops the machine before detaching its
+	// disks during recovery
+	RecoveryStopMachine bool
+	// ClusterID identifies the cluster the disks are created for, it is
+	// stored on the disks together with the name of their PersistentVolume
+	ClusterID string
+	// GCInterval is the interval at which disks created for the cluster
+	// that no PersistentVolume refers to are collected. Collecting them is
+	// disabled if it is 0, and requires a ClusterID otherwise.
+	GCInterval time.Duration
+	// GCGracePeriod is how long a disk has to be orphaned before it is
+	// deleted, defaults to 24 hours
+	GCGracePeriod time.Duration
+	// GCDryRun only reports orphaned disks instead of deleting them
+	GCDryRun bool
+	// PodName and PodNamespace identify the pod of the driver, events are
+	// recorded on it. Events are only logged if PodName is empty.
+	PodName      string
+	PodNamespace string
 }
 
 // Driver struct contains all relevant Driver information
 type Driver struct {
-	endpoint     string
-	client       *ovc.Client
-	accountID    int
-	gridID       int
-	nodeID       string
-	cloudspaceID int
-
-	attacher bool
-	attach   chan attachConfig
-	detach   chan attachConfig
+	endpoint   string
+	client     *ovcClient
+	accountID  int
+	locations  ovc.LocationList
+	nodeID     string
+	nodeGridID int
+	hostRoot   string
+
+	mode     Mode
+	attacher *attacher
+	// attacherConfig is the configuration of the attachers of all accounts
+	attacherConfig attacherConfig
+
+	// url and verbose configure the OVC clients created for the
+	// credentials in the secrets of requests
+	url     string
+	verbose bool
+	tenants tenants
+
+	// clusterID is stored on the disks created by the driver
+	clusterID string
+	// gc collects orphaned disks, it is nil if disabled
+	gc *garbageCollector
+
+	debugAddress string
+	debugSrv     *http.Server
+
+	metrics        *metrics
+	metricsAddress string
+	metricsSrv     *http.Server
+
+	health        health
+	healthAddress string
+	healthSrv     *http.Server
 
 	volumeCaps     []csi.VolumeCapability_AccessMode
 	controllerCaps []csi.ControllerServiceCapability_RPC_Type
@@ -60,66 +201,111 @@ type Driver struct {
 	log     *logrus.Entry
 	mounter *mount.SafeFormatAndMount
 
-	quit         chan bool
-	jwtRefresher *time.Ticker
+	jwt  jwtState
+	quit chan bool
+	// jwtMaintainerDone is closed when the JWT maintainer stopped
+	jwtMaintainerDone chan struct{}
+
+	shutdownTimeout time.Duration
+	// mu guards the servers started by Run against Stop
+	mu sync.Mutex
+	// socketPath is the path of the unix socket the driver listens on
+	socketPath string
+	stopped    bool
+	stopOnce   sync.Once
 }
 
+// defaultShutdownTimeout is the default time Stop waits for running
+// operations, it leaves some time before Kubernetes kills the container
+// after its default termination grace period of 30 seconds
+const defaultShutdownTimeout = 25 * time.Second
+
 var (
 	version string
 )
 
 // NewDriver creates a new driver
-func NewDriver(url, endpoint, account string, mounter *mount.SafeFormatAndMount, ovcJWT string, verbose bool, attacher bool) (*Driver, error) {
+func NewDriver(config *Config) (*Driver, error) {
 	c := &ovc.Config{
-		URL:     url,
-		JWT:     ovcJWT,
-		Verbose: verbose,
+		URL:     config.URL,
+		Verbose: config.Verbose,
+	}
+	switch config.AuthMode {
+	case ClientCredentialsAuth:
+		if config.ClientID == "" || config.ClientSecret == "" {
+			return nil, fmt.Errorf("client ID and secret are required for %s authentication", ClientCredentialsAuth)
+		}
+		c.ClientID = config.ClientID
+		c.ClientSecret = config.ClientSecret
+	default:
+		c.JWT = config.JWT
+		if config.JWTFile != "" {
+			var err error
+			if c.JWT, err = readJWTFile(config.JWTFile); err != nil {
+				return nil, err
+			}
+		}
 	}
-	client, err := ovc.NewClient(c)
+	client, err := newOVCClient(c)
 	if err != nil {
 		return nil, err
 	}
 
-	// Fetch grid ID
-	locations, err := client.Locations.List()
+	return newDriver(config, client)
+}
+
+// newDriver creates a new driver which talks to the OVC API through the
+// given client
+func newDriver(config *Config, client *ovcClient) (*Driver, error) {
+	mode := config.Mode
+	if mode == "" {
+		mode = AllMode
+	}
+	if config.GCInterval > 0 && config.ClusterID == "" {
+		return nil, fmt.Errorf("a cluster ID is required to collect orphaned disks")
+	}
+
+	log := logrus.New()
+	if config.Verbose {
+		log.SetLevel(logrus.DebugLevel)
+	} else {
+		log.SetLevel(logrus.InfoLevel)
+	}
+
+	metrics := newMetrics()
+	client = client.instrumented(metrics).withRetries(newRetrier(log.WithField("mode", mode)))
+
+	ctx := context.Background()
+
+	// Volumes are created in the location picked for their topology
+	locations, err := client.Locations.List(ctx)
 	if err != nil {
 		return nil, err
 	}
-	gridID := (*locations)[0].GridID
 
-	accountID, err := client.Accounts.GetIDByName(account)
+	accountID, err := client.Accounts.GetIDByName(ctx, config.Account)
 	if err != nil {
 		return nil, err
 	}
 
+	mounter := config.Mounter
 	if mounter == nil {
 		mounter = newSafeMounter()
 	}
 
-	nodeID, cloudspaceID, err := getNodeID(client)
-	if err != nil {
-		return nil, fmt.Errorf("something went wrong fetching the node ID %s", err)
-	}
-
-	log := logrus.New()
-	if verbose {
-		log.SetLevel(logrus.DebugLevel)
-	} else {
-		log.SetLevel(logrus.InfoLevel)
+	hostRoot := config.HostRoot
+	if hostRoot == "" {
+		hostRoot = "/"
 	}
-	logEntry := log.WithFields(logrus.Fields{
-		"node_id": nodeID,
-	})
 
 	driver := &Driver{
-		gridID:       gridID,
-		client:       client,
-		endpoint:     endpoint,
-		accountID:    accountID,
-		nodeID:       nodeID,
-		cloudspaceID: cloudspaceID,
-		mounter:      mounter,
-		log:          logEntry,
+		locations: *locations,
+		client:    client,
+		endpoint:  config.Endpoint,
+		accountID: accountID,
+		mounter:   mounter,
+		hostRoot:  hostRoot,
+		log:       log.WithField("mode", mode),
 		volumeCaps: []csi.VolumeCapability_AccessMode{
 			{
 				Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
@@ -128,47 +314,85 @@ func NewDriver(url, endpoint, account string, mounter *mount.SafeFormatAndMount,
 		controllerCaps: []csi.ControllerServiceCapability_RPC_Type{
 			csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 			csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+			csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+			csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 		},
 		nodeCaps: []csi.NodeServiceCapability_RPC_Type{
 			csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+			csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+			csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 		},
-		attacher: attacher,
-		quit:     make(chan bool),
-	}
-
-	driver.log.Info("Starting JWT maintainer to refresh the JWT at least once each 30 days.")
-	driver.client.JWT.Get()
-	driver.jwtRefresher = time.NewTicker(29 * 24 * time.Hour)
-	go func() {
-		for {
-			select {
-			case <-driver.quit:
-				return
-			case <-driver.jwtRefresher.C:
-				for {
-					if _, err := driver.client.JWT.Get(); err != nil {
-						driver.log.Errorf("Error refreshing the JWT: %s", err)
-					} else {
-						break
-					}
-					// Sleep 60 seconds before retrying unless quiting
-					for i := 0; i < 60; i++ {
-						select {
-						case <-driver.quit:
-							return
-						default:
-							time.Sleep(1 * time.Second)
-						}
-					}
-				}
-			}
+		mode:              mode,
+		url:               config.URL,
+		verbose:           config.Verbose,
+		tenants:           newTenants(newOVCClient),
+		clusterID:         config.ClusterID,
+		debugAddress:      config.DebugAddress,
+		metrics:           metrics,
+		metricsAddress:    config.MetricsAddress,
+		healthAddress:     config.HealthAddress,
+		quit:              make(chan bool),
+		jwtMaintainerDone: make(chan struct{}),
+		shutdownTimeout:   config.ShutdownTimeout,
+	}
+
+	// Only nodes run on an OVC VM which can be identified through DMI
+	if mode.servesNode() {
+		nodeID, cloudspaceID, err := getNodeID(ctx, hostRoot, client.Machines)
+		if err != nil {
+			return nil, fmt.Errorf("something went wrong fetching the node ID %s", err)
+		}
+
+		cloudspace, err := client.CloudSpaces.Get(ctx, cloudspaceID)
+		if err != nil {
+			return nil, fmt.Errorf("something went wrong fetching the cloudspace of the node %s", err)
 		}
-	}()
 
-	if attacher {
-		driver.attach = make(chan attachConfig)
-		driver.detach = make(chan attachConfig)
-		go driver.runOVCStatemachine()
+		driver.nodeID = nodeID
+		driver.nodeGridID = cloudspace.GridID
+		driver.log = driver.log.WithField("node_id", nodeID)
+	}
+
+	// The JWT file is ignored when authenticating with client credentials,
+	// so the same manifests can be used for both
+	driver.jwt.renewed = config.AuthMode == ClientCredentialsAuth
+	if config.JWTFile != "" && !driver.jwt.renewed {
+		driver.jwt.file = config.JWTFile
+		if driver.jwt.loaded, err = readJWTFile(config.JWTFile); err != nil {
+			return nil, err
+		}
+	}
+	if err := driver.checkJWT(ctx); err != nil {
+		driver.log.Errorf("JWT is not usable: %s", err)
+	}
+	go driver.maintainJWT(ctx)
+
+	if mode.servesController() {
+		events, err := newEventRecorder(config.PodName, config.PodNamespace, driver.log)
+		if err != nil {
+			return nil, err
+		}
+		driver.attacherConfig = attacherConfig{
+			resync:              config.InventoryResync,
+			recoveryGracePeriod: config.RecoveryGracePeriod,
+			recoveryStopMachine: config.RecoveryStopMachine,
+			events:              events,
+		}
+		if driver.attacherConfig.resync == 0 {
+			driver.attacherConfig.resync = defaultInventoryResync
+		}
+		driver.attacher = newAttacher(client, accountID, driver.attacherConfig, driver.log)
+		driver.attacher.start()
+		metrics.observeAttachers(driver.attachers)
+
+		if config.GCInterval > 0 {
+			volumes, err := kubeVolumeLister()
+			if err != nil {
+				return nil, err
+			}
+			driver.gc = newGarbageCollector(config, volumes)
+			go driver.runGarbageCollector(ctx)
+		}
 	}
 
 	return driver, nil
@@ -183,6 +407,7 @@ func (d *Driver) Run() error {
 
 	addr := path.Join(u.Host, filepath.FromSlash(u.Path))
 
+	var socketPath string
 	switch u.Scheme {
 	case "unix", "unixgram", "unixpacket":
 		// Check if file already exists and clean it up
@@ -192,6 +417,7 @@ func (d *Driver) Run() error {
 				return fmt.Errorf("failed to remove socket file (%s): %s", u.Path, err)
 			}
 		}
+		socketPath = u.Path
 	}
 
 	listener, err := net.Listen(u.Scheme, addr)
@@ -199,165 +425,133 @@ func (d *Driver) Run() error {
 		return err
 	}
 
-	logErr := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		resp, err := handler(ctx, req)
-		if err != nil {
-			d.log.Errorf("GRPC error: %v", err)
-		}
-		return resp, err
-	}
 	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logErr),
+		grpc.UnaryInterceptor(d.intercept),
 	}
-	d.srv = grpc.NewServer(opts...)
+	srv := grpc.NewServer(opts...)
 
-	csi.RegisterIdentityServer(d.srv, d)
-	csi.RegisterControllerServer(d.srv, d)
-	csi.RegisterNodeServer(d.srv, d)
-
-	d.log.Infof("Listening for connections on address: %#v", listener.Addr())
-	return d.srv.Serve(listener)
-}
+	csi.RegisterIdentityServer(srv, d)
+	if d.mode.servesController() {
+		csi.RegisterControllerServer(srv, d)
+	}
+	if d.mode.servesNode() {
+		csi.RegisterNodeServer(srv, d)
+	}
 
-// Stop stops the plugin
-func (d *Driver) Stop() {
-	d.log.Info("Server stopped")
-	d.srv.Stop()
-	d.log.Info("Waiting for JWT refresher to finish")
-	close(d.quit)
-	if d.attacher {
-		close(d.attach)
-		close(d.detach)
+	// The servers are set while holding mu, so Stop either finds them or
+	// Run sees the driver is stopped
+	d.mu.Lock()
+	if d.stopped {
+		d.mu.Unlock()
+		listener.Close()
+		return nil
+	}
+	d.srv = srv
+	d.socketPath = socketPath
+	if d.debugAddress != "" {
+		d.serveDebug()
+	}
+	if d.metricsAddress != "" {
+		d.serveMetrics()
+	}
+	if d.healthAddress != "" {
+		d.serveHealth()
 	}
-	d.jwtRefresher.Stop()
-}
 
-// GetVersion returns the current version
-func GetVersion() string {
-	return version
-}
+	d.mu.Unlock()
 
-func newSafeMounter() *mount.SafeFormatAndMount {
-	return &mount.SafeFormatAndMount{
-		Interface: mount.New(""),
-		Exec:      mount.NewOsExec(),
-	}
+	d.log.Infof("Listening for connections on address: %#v", listener.Addr())
+	return srv.Serve(listener)
 }
 
-func (d *Driver) createStateInventory() (map[int][]int, error) {
-	machines, err := d.client.Machines.List(d.cloudspaceID)
-	if err != nil {
-		return nil, err
+// intercept records and logs the result of every RPC. Controller RPCs are
+// refused while the JWT is expired, as every OVC API call would fail.
+func (d *Driver) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	var resp interface{}
+	err := d.jwtExpired()
+	if err != nil && strings.HasPrefix(info.FullMethod, "/csi.v1.Controller/") {
+		err = status.Errorf(codes.Unauthenticated, "%s, the OVC credentials of the driver need to be rotated", err)
+	} else {
+		resp, err = handler(ctx, req)
 	}
-	state := make(map[int][]int)
-	for _, machine := range *machines {
-		state[machine.ID] = machine.Disks
+	d.metrics.observeRPC(info.FullMethod, status.Code(err), time.Since(start))
+	if err != nil {
+		d.log.Errorf("GRPC error: %v", err)
 	}
-	return state, nil
+	return resp, err
 }
 
-func (d *Driver) runOVCStatemachine() {
-	var state map[int][]int
-	var ac attachConfig
+// Stop stops the plugin gracefully. It stops accepting RPCs and waits up to
+// the shutdown timeout for the running RPCs and the queued attaches and
+// detaches to finish before canceling them.
+func (d *Driver) Stop() {
+	d.stopOnce.Do(d.stop)
+}
 
-	newStateMachine := func() {
-		var err error
-		d.log.Info("Creating ovc state machine")
-		for {
-			if state, err = d.createStateInventory(); err == nil {
-				break
-			}
-			d.log.Warning("Failed to create state machine. Retrying in 30 seconds")
-			time.Sleep(30 * time.Second)
+func (d *Driver) stop() {
+	timeout := d.shutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	d.mu.Lock()
+	d.stopped = true
+	d.mu.Unlock()
+
+	if d.srv != nil {
+		d.log.Info("Waiting for running requests to finish")
+		stopped := make(chan struct{})
+		go func() {
+			d.srv.GracefulStop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(timeout):
+			d.log.Warningf("Canceling requests still running after %s", timeout)
+			d.srv.Stop()
 		}
 	}
+	if d.debugSrv != nil {
+		d.debugSrv.Close()
+	}
+	if d.metricsSrv != nil {
+		d.metricsSrv.Close()
+	}
+	if d.healthSrv != nil {
+		d.healthSrv.Close()
+	}
+	if d.attacher != nil {
+		d.log.Info("Waiting for queued attaches and detaches to finish")
+		d.attacher.stop(time.Until(deadline))
+	}
+	d.stopTenantAttachers(time.Until(deadline))
 
-	indexOf := func(slice []int, value int) int {
-		for i, v := range slice {
-			if v == value {
-				return i
-			}
-		}
-		return -1
-	}
-
-	remove := func(slice []int, i int) []int {
-		slice[len(slice)-1], slice[i] = slice[i], slice[len(slice)-1]
-		return slice[:len(slice)-1]
-	}
-
-	attach := func() error {
-		for machineID, disks := range state {
-			if index := indexOf(disks, ac.diskID); index >= 0 {
-				if machineID == ac.machineID {
-					d.log.Infof("Nothing to do, this disk %d is already attached to machine %d", ac.diskID, machineID)
-					ac.result <- nil
-					return nil
-				}
-				// Disk is attached to the wrong machine: disconnect
-				if err := d.client.Disks.Detach(&ovc.DiskAttachConfig{
-					MachineID: machineID,
-					DiskID:    ac.diskID,
-				}); err != nil {
-					d.log.Errorf("Failed to detach disk %d from machine %d: %s", ac.diskID, machineID, err)
-					ac.result <- err
-					return err
-				}
-				d.log.Infof("Detached disk %d from machine %d", ac.diskID, machineID)
-				state[machineID] = remove(disks, index)
-				break
-			}
-		}
-		// Attach the disk to the correct machine
-		if err := d.client.Disks.Attach(&ovc.DiskAttachConfig{
-			MachineID: ac.machineID,
-			DiskID:    ac.diskID,
-		}); err != nil {
-			d.log.Errorf("Failed to attach disk %d to machine %d: %s", ac.diskID, ac.machineID, err)
-			ac.result <- err
-			return err
-		}
-		state[ac.machineID] = append(state[ac.machineID], ac.diskID)
-		ac.result <- nil
-		d.log.Errorf("Attached disk %d to machine %d", ac.diskID, ac.machineID)
-		return nil
+	d.log.Info("Waiting for JWT maintainer to finish")
+	close(d.quit)
+	<-d.jwtMaintainerDone
+	if d.gc != nil {
+		<-d.gc.done
 	}
 
-	detach := func() error {
-		for machineID, disks := range state {
-			if index := indexOf(disks, ac.diskID); index >= 0 {
-				if err := d.client.Disks.Detach(&ovc.DiskAttachConfig{
-					MachineID: machineID,
-					DiskID:    ac.diskID,
-				}); err != nil {
-					d.log.Errorf("Failed to detach disk %d from machine %d: %s", ac.diskID, machineID, err)
-					ac.result <- err
-					return err
-				}
-				d.log.Infof("Detached disk %d from machine %d", ac.diskID, machineID)
-				state[machineID] = remove(disks, index)
-				break
-			}
+	if d.socketPath != "" {
+		if err := os.Remove(d.socketPath); err != nil && !os.IsNotExist(err) {
+			d.log.Warningf("Failed to remove socket file (%s): %s", d.socketPath, err)
 		}
-		ac.result <- nil
-		return nil
 	}
+	d.log.Info("Server stopped")
+}
 
-	newStateMachine()
-	for {
-		select {
-		case ac = <-d.attach:
-			if err := attach(); err != nil {
-				d.log.Info("Error while executing attach request. Recycling state machine")
-				newStateMachine()
-			}
-		case ac = <-d.detach:
-			if err := detach(); err != nil {
-				d.log.Info("Error while executing detach request. Recycling state machine")
-				newStateMachine()
-			}
-		case <-d.quit:
-			break
-		}
+// GetVersion returns the current version
+func GetVersion() string {
+	return version
+}
+
+func newSafeMounter() *mount.SafeFormatAndMount {
+	return &mount.SafeFormatAndMount{
+		Interface: mount.New(""),
+		Exec:      mount.NewOsExec(),
 	}
 }
@@ -0,0 +1,72 @@
+package driver
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDriverStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ovc-csi")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "csi.sock")
+
+	f := newFakeOVC()
+	d, err := newDriver(&Config{
+		Account:  fakeAccountName,
+		Endpoint: "unix://" + socket,
+		Mode:     ControllerMode,
+	}, f.client())
+	require.NoError(t, err)
+
+	run := async(d.Run)
+	waitFor(t, func() bool {
+		_, err := os.Stat(socket)
+		return err == nil
+	})
+
+	d.Stop()
+	require.NoError(t, <-run)
+	_, err = os.Stat(socket)
+	require.True(t, os.IsNotExist(err))
+
+	// Stopping twice is a no-op
+	d.Stop()
+}
+
+func TestParseAuthMode(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  AuthMode
+		error bool
+	}{
+		{name: "", mode: JWTAuth},
+		{name: "jwt", mode: JWTAuth},
+		{name: "client-credentials", mode: ClientCredentialsAuth},
+		{name: "password", error: true},
+	}
+
+	for _, tt := range tests {
+		mode, err := ParseAuthMode(tt.name)
+		if tt.error {
+			require.Error(t, err, tt.name)
+			continue
+		}
+		require.NoError(t, err, tt.name)
+		require.Equal(t, tt.mode, mode, tt.name)
+	}
+}
+
+func TestNewDriverRequiresClientCredentials(t *testing.T) {
+	_, err := NewDriver(&Config{
+		AuthMode: ClientCredentialsAuth,
+		ClientID: "client",
+		JWT:      "ignored",
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "client ID and secret are required")
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// gatewayErrorPages are the titles of the error pages of the nginx in front
+// of the OVC API when it can't reach the API. The OVC SDK drops the HTTP
+// status of failed requests and returns the response body as error, so these
+// pages are the only failures of the API that can be told apart by their
+// message. Other failures, like missing disks or an exceeded quota, are
+// checked against the API by the calls that depend on them.
+var gatewayErrorPages = []string{
+	"<title>502 Bad Gateway</title>",
+	"<title>503 Service Temporarily Unavailable</title>",
+	"<title>504 Gateway Time-out</title>",
+}
+
+// jobTimeoutPrefix prefixes the error the OVC SDK returns when the task of a
+// call didn't finish in time
+const jobTimeoutPrefix = "job timeout "
+
+// errorCode classifies an error of an OVC API call into the gRPC code to
+// return for it
+func errorCode(err error) codes.Code {
+	switch err {
+	case nil:
+		return codes.OK
+	case context.Canceled:
+		return codes.Canceled
+	case context.DeadlineExceeded:
+		return codes.DeadlineExceeded
+	case ovc.ErrNotFound:
+		return codes.NotFound
+	case ovc.ErrAuthentication, ovc.ErrExpiredJWT:
+		return codes.Unauthenticated
+	case io.EOF, io.ErrUnexpectedEOF:
+		return codes.Unavailable
+	}
+	if s, ok := status.FromError(err); ok {
+		return s.Code()
+	}
+	// Failing connections to the API, including url.Error
+	if _, ok := err.(net.Error); ok {
+		return codes.Unavailable
+	}
+
+	message := err.Error()
+	if strings.HasPrefix(message, jobTimeoutPrefix) {
+		return codes.Unavailable
+	}
+	for _, page := range gatewayErrorPages {
+		if strings.Contains(message, page) {
+			return codes.Unavailable
+		}
+	}
+	return codes.Internal
+}
+
+// apiError returns the gRPC error to return for an error of an OVC API
+// call. gRPC errors are returned as is.
+func apiError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return status.FromContextError(err).Err()
+	}
+	return status.Error(errorCode(err), err.Error())
+}
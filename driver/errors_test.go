@@ -0,0 +1,100 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestAPIError(t *testing.T) {
+	tt := []struct {
+		name string
+		err  error
+		code codes.Code
+	}{
+		{
+			name: "not found",
+			err:  ovc.ErrNotFound,
+			code: codes.NotFound,
+		},
+		{
+			name: "not found message",
+			err:  errNotFound("disk", 42),
+			code: codes.Internal,
+		},
+		{
+			name: "authentication",
+			err:  ovc.ErrAuthentication,
+			code: codes.Unauthenticated,
+		},
+		{
+			name: "expired JWT",
+			err:  ovc.ErrExpiredJWT,
+			code: codes.Unauthenticated,
+		},
+		{
+			name: "bad gateway",
+			err:  errGateway("502 Bad Gateway"),
+			code: codes.Unavailable,
+		},
+		{
+			name: "service unavailable",
+			err:  errGateway("503 Service Temporarily Unavailable"),
+			code: codes.Unavailable,
+		},
+		{
+			name: "gateway timeout",
+			err:  errGateway("504 Gateway Time-out"),
+			code: codes.Unavailable,
+		},
+		{
+			name: "job timeout",
+			err:  errors.New("job timeout 3f1c0a5e-6a1b-4d8e-9a55-0d2b8c1e7f42"),
+			code: codes.Unavailable,
+		},
+		{
+			name: "task failed",
+			err:  errors.New("3f1c0a5e-6a1b-4d8e-9a55-0d2b8c1e7f42"),
+			code: codes.Internal,
+		},
+		{
+			name: "unsuccessful task",
+			err:  fmt.Errorf("Task was not successfull taskID: %v:\n %v", "3f1c0a5e-6a1b-4d8e-9a55-0d2b8c1e7f42", "Request timeout while detaching disk"),
+			code: codes.Internal,
+		},
+		{
+			name: "connection failure",
+			err:  &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")},
+			code: codes.Unavailable,
+		},
+		{
+			name: "deadline exceeded",
+			err:  context.DeadlineExceeded,
+			code: codes.DeadlineExceeded,
+		},
+		{
+			name: "gRPC error",
+			err:  status.Error(codes.FailedPrecondition, "machine is down"),
+			code: codes.FailedPrecondition,
+		},
+		{
+			name: "unknown",
+			err:  fmt.Errorf("disk %d can not be shrunk", 1),
+			code: codes.Internal,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := apiError(tc.err)
+			require.Equal(t, tc.code, status.Code(err), "unexpected error: %v", err)
+		})
+	}
+}
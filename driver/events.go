@@ -0,0 +1,88 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+)
+
+// eventRecorder records decisions of the driver that affect workloads, like
+// fencing a machine, so they show up next to the workload's own events
+type eventRecorder interface {
+	Eventf(eventType, reason, messageFmt string, args ...interface{})
+}
+
+// logEventRecorder logs events, it is used when the driver doesn't run in a
+// pod
+type logEventRecorder struct {
+	log *logrus.Entry
+}
+
+func (r *logEventRecorder) Eventf(eventType, reason, messageFmt string, args ...interface{}) {
+	r.log.WithFields(logrus.Fields{
+		"event_type": eventType,
+		"reason":     reason,
+	}).Infof(messageFmt, args...)
+}
+
+// kubeEventRecorder records events on the pod of the driver
+type kubeEventRecorder struct {
+	recorder record.EventRecorder
+	pod      *v1.ObjectReference
+}
+
+func (r *kubeEventRecorder) Eventf(eventType, reason, messageFmt string, args ...interface{}) {
+	r.recorder.Eventf(r.pod, eventType, reason, messageFmt, args...)
+}
+
+// newEventRecorder returns a recorder emitting Kubernetes events on the
+// given pod, or one that only logs if podName is empty
+func newEventRecorder(podName, podNamespace string, log *logrus.Entry) (eventRecorder, error) {
+	if podName == "" {
+		return &logEventRecorder{log: log}, nil
+	}
+
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load in-cluster Kubernetes config: %s", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(log.Infof)
+	broadcaster.StartRecordingToSink(&typedv1.EventSinkImpl{Interface: clientset.CoreV1().Events(podNamespace)})
+
+	return &kubeEventRecorder{
+		recorder: broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: driverName}),
+		pod: &v1.ObjectReference{
+			Kind:      "Pod",
+			Name:      podName,
+			Namespace: podNamespace,
+		},
+	}, nil
+}
@@ -0,0 +1,743 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	jwtLib "github.com/dgrijalva/jwt-go"
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// fakeOVC is an in-memory implementation of the OVC API operations used by
+// the driver. It models disks, machines, attachments and the disk quotas
+// of accounts and cloudspaces. Failures can be injected per operation.
+type fakeOVC struct {
+	mu sync.Mutex
+
+	lastID      int
+	accounts    map[int]*AccountDetails
+	cloudspaces map[int]*ovc.CloudSpace
+	locations   ovc.LocationList
+	machines    map[int]*fakeMachine
+	disks       map[int]*ovc.DiskInfo
+	// attachments maps disk IDs to the ID of the machine they are attached to
+	attachments map[int]int
+	jwt         string
+
+	failures map[string]error
+	// failuresLeft limits the number of calls failing with the injected
+	// failure of an operation
+	failuresLeft map[string]int
+	calls        map[string]int
+	gates        map[string]chan struct{}
+	latency      time.Duration
+}
+
+type fakeMachine struct {
+	id           int
+	cloudspaceID int
+	referenceID  string
+	status       string
+}
+
+const (
+	fakeAccountName = "test-account"
+	fakeGridID      = 1
+	fakeLocation    = "be-test-1"
+	// fakeFirstPCISlot is the first PCI slot data disks are attached on
+	fakeFirstPCISlot = 10
+)
+
+// newFakeOVC returns a fake with a single account, location and cloudspace
+// without disk quotas
+func newFakeOVC() *fakeOVC {
+	f := &fakeOVC{
+		accounts:     make(map[int]*AccountDetails),
+		cloudspaces:  make(map[int]*ovc.CloudSpace),
+		locations:    ovc.LocationList{{GridID: fakeGridID, Code: fakeLocation}},
+		machines:     make(map[int]*fakeMachine),
+		disks:        make(map[int]*ovc.DiskInfo),
+		attachments:  make(map[int]int),
+		failures:     make(map[string]error),
+		failuresLeft: make(map[string]int),
+		calls:        make(map[string]int),
+		gates:        make(map[string]chan struct{}),
+		jwt:          newFakeJWT(time.Now().Add(time.Hour)),
+	}
+	f.addAccount(fakeAccountName, -1)
+	return f
+}
+
+// newFakeJWT returns a JWT expiring at the given time
+func newFakeJWT(expiry time.Time) string {
+	jwt, err := jwtLib.NewWithClaims(jwtLib.SigningMethodHS256, jwtLib.MapClaims{
+		"exp": expiry.Unix(),
+	}).SignedString([]byte("fake"))
+	if err != nil {
+		panic(err)
+	}
+	return jwt
+}
+
+// client returns an ovcClient backed by the fake
+func (f *fakeOVC) client() *ovcClient {
+	return &ovcClient{
+		Disks:       &fakeDiskService{f},
+		Machines:    &fakeMachineService{f},
+		Accounts:    &fakeAccountService{f},
+		CloudSpaces: &fakeCloudSpaceService{f},
+		Locations:   &fakeLocationService{f},
+		JWT:         &fakeJWT{f},
+	}
+}
+
+func (f *fakeOVC) nextID() int {
+	f.lastID++
+	return f.lastID
+}
+
+// addAccount adds an account with the given disk quota in GiB, a negative
+// quota means unlimited
+func (f *fakeOVC) addAccount(name string, quotaGiB int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.nextID()
+	f.accounts[id] = &AccountDetails{
+		ID:             id,
+		Name:           name,
+		ResourceLimits: ovc.ResourceLimits{CUD: quotaGiB},
+	}
+	return id
+}
+
+// accountID returns the ID of the default account of the fake
+func (f *fakeOVC) accountID() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for id, account := range f.accounts {
+		if account.Name == fakeAccountName {
+			return id
+		}
+	}
+	return 0
+}
+
+// setAccountQuota sets the disk quota in GiB of an account
+func (f *fakeOVC) setAccountQuota(accountID int, quotaGiB int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.accounts[accountID].ResourceLimits.CUD = quotaGiB
+}
+
+// addCloudSpace adds a cloudspace with the given disk quota in GiB
+func (f *fakeOVC) addCloudSpace(accountID int, quotaGiB int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.nextID()
+	f.cloudspaces[id] = &ovc.CloudSpace{
+		ID:             id,
+		AccountID:      accountID,
+		GridID:         fakeGridID,
+		Location:       fakeLocation,
+		ResourceLimits: ovc.ResourceLimits{CUD: quotaGiB},
+	}
+	return id
+}
+
+// machineReferenceID returns the reference ID of a machine, which is the
+// DMI product UUID of the VM
+func (f *fakeOVC) machineReferenceID(machineID int) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.machines[machineID].referenceID
+}
+
+// addMachine adds a running machine to a cloudspace
+func (f *fakeOVC) addMachine(cloudspaceID int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.nextID()
+	f.machines[id] = &fakeMachine{
+		id:           id,
+		cloudspaceID: cloudspaceID,
+		referenceID:  fmt.Sprintf("4c4c4544-0000-0000-00ab-%012d", id),
+		status:       "RUNNING",
+	}
+	return id
+}
+
+// setMachineStatus sets the OVC status of a machine, like "HALTED"
+func (f *fakeOVC) setMachineStatus(machineID int, status string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.machines[machineID].status = status
+}
+
+// deleteMachine deletes a machine, which detaches its disks
+func (f *fakeOVC) deleteMachine(machineID int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for diskID, attachedTo := range f.attachments {
+		if attachedTo == machineID {
+			delete(f.attachments, diskID)
+			f.disks[diskID].PCISlot = 0
+		}
+	}
+	delete(f.machines, machineID)
+}
+
+// addDisk adds a data disk of the given size in GiB to an account
+func (f *fakeOVC) addDisk(accountID int, name string, sizeGiB int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := f.nextID()
+	f.disks[id] = &ovc.DiskInfo{
+		ID:        id,
+		AccountID: accountID,
+		GridID:    fakeGridID,
+		Name:      name,
+		SizeMax:   sizeGiB,
+		Type:      defaultDiskType,
+		Status:    "CREATED",
+	}
+	return id
+}
+
+// setDiskDescription sets the description of a disk
+func (f *fakeOVC) setDiskDescription(diskID int, description string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.disks[diskID].Descr = description
+}
+
+// attachDisk attaches a disk to a machine without going through the API and
+// returns the PCI slot it is attached on
+func (f *fakeOVC) attachDisk(diskID, machineID int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attachments[diskID] = machineID
+	f.disks[diskID].PCISlot = f.freePCISlot(machineID)
+	return f.disks[diskID].PCISlot
+}
+
+// detachDisk detaches a disk without going through the API
+func (f *fakeOVC) detachDisk(diskID int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.attachments, diskID)
+	f.disks[diskID].PCISlot = 0
+}
+
+// attachedTo returns the ID of the machine a disk is attached to, or 0
+func (f *fakeOVC) attachedTo(diskID int) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.attachments[diskID]
+}
+
+// disk returns a copy of a disk, or nil if it doesn't exist
+func (f *fakeOVC) disk(diskID int) *ovc.DiskInfo {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	disk, ok := f.disks[diskID]
+	if !ok {
+		return nil
+	}
+	diskCopy := *disk
+	return &diskCopy
+}
+
+// failOn makes every call of the given operation, like "Disks.Attach", fail
+// with err until it is reset with a nil error
+func (f *fakeOVC) failOn(op string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.failures, op)
+		return
+	}
+	f.failures[op] = err
+	delete(f.failuresLeft, op)
+}
+
+// failTimes makes the next n calls of the given operation fail with err
+func (f *fakeOVC) failTimes(op string, err error, n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[op] = err
+	f.failuresLeft[op] = n
+}
+
+// callCount returns how many times an operation was called
+func (f *fakeOVC) callCount(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[op]
+}
+
+// hold makes calls of the given operation block until the returned function
+// is called
+func (f *fakeOVC) hold(op string) func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	gate := make(chan struct{})
+	f.gates[op] = gate
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.gates, op)
+		close(gate)
+	}
+}
+
+// call registers a call of an operation, waits while the operation is held,
+// simulates the latency of the API and locks the fake. It returns the
+// injected failure of the operation, or the error of ctx if it is done while
+// waiting. The caller must unlock the fake when done.
+func (f *fakeOVC) call(ctx context.Context, op string) error {
+	f.mu.Lock()
+	f.calls[op]++
+	gate := f.gates[op]
+	f.mu.Unlock()
+
+	err := ctx.Err()
+	if err == nil && gate != nil {
+		select {
+		case <-gate:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	if err == nil && f.latency > 0 {
+		select {
+		case <-time.After(f.latency):
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	f.mu.Lock()
+	if err != nil {
+		return err
+	}
+	err = f.failures[op]
+	if n, ok := f.failuresLeft[op]; ok {
+		if n <= 1 {
+			delete(f.failures, op)
+			delete(f.failuresLeft, op)
+		} else {
+			f.failuresLeft[op] = n - 1
+		}
+	}
+	return err
+}
+
+// errNotFound returns the error the OVC SDK returns when the API responds
+// with 404: the response body as message. The SDK only returns
+// ovc.ErrNotFound when the result of a task can't be found.
+func errNotFound(kind string, id interface{}) error {
+	return errors.New(fmt.Sprintf("%s %v not found", kind, id))
+}
+
+// errGateway returns the error the OVC SDK returns when the nginx in front
+// of the API responds with an error page with the given title, like
+// "502 Bad Gateway"
+func errGateway(title string) error {
+	return fmt.Errorf("<html>\r\n<head><title>%[1]s</title></head>\r\n<body>\r\n<center><h1>%[1]s</h1></center>\r\n<hr><center>nginx/1.17.6</center>\r\n</body>\r\n</html>\r\n", title)
+}
+
+// usedGiB returns the disk space used by the disks of an account, and of the
+// ones attached to machines of a cloudspace if cloudspaceID isn't 0
+func (f *fakeOVC) usedGiB(accountID, cloudspaceID int) int {
+	used := 0
+	for id, disk := range f.disks {
+		if disk.AccountID != accountID {
+			continue
+		}
+		if cloudspaceID != 0 {
+			machine, ok := f.machines[f.attachments[id]]
+			if !ok || machine.cloudspaceID != cloudspaceID {
+				continue
+			}
+		}
+		used += disk.SizeMax
+	}
+	return used
+}
+
+// checkQuota returns an error if adding sizeGiB to the account would exceed
+// its disk quota
+func (f *fakeOVC) checkQuota(accountID, sizeGiB int) error {
+	account, ok := f.accounts[accountID]
+	if !ok {
+		return errNotFound("account", accountID)
+	}
+	quota := account.ResourceLimits.CUD
+	if quota >= 0 && f.usedGiB(accountID, 0)+sizeGiB > quota {
+		return errors.New("disk capacity exceeds the account quota")
+	}
+	return nil
+}
+
+type fakeDiskService struct{ f *fakeOVC }
+
+func (s *fakeDiskService) List(ctx context.Context, accountID int, diskType string) (*[]ovc.Disk, error) {
+	f := s.f
+	err := f.call(ctx, "Disks.List")
+	defer f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	disks := []ovc.Disk{}
+	for _, disk := range f.disks {
+		if disk.AccountID != accountID || (diskType != "" && disk.Type != diskType) {
+			continue
+		}
+		disks = append(disks, ovc.Disk{
+			ID:          disk.ID,
+			AccountID:   disk.AccountID,
+			Name:        disk.Name,
+			Description: disk.Descr,
+			Size:        disk.SizeMax,
+			Type:        disk.Type,
+			Status:      disk.Status,
+		})
+	}
+	return &disks, nil
+}
+
+func (s *fakeDiskService) Get(ctx context.Context, diskID int) (*ovc.DiskInfo, error) {
+	f := s.f
+	err := f.call(ctx, "Disks.Get")
+	defer f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	disk, ok := f.disks[diskID]
+	if !ok {
+		return nil, errNotFound("disk", diskID)
+	}
+	diskCopy := *disk
+	return &diskCopy, nil
+}
+
+func (s *fakeDiskService) Create(ctx context.Context, diskConfig *ovc.DiskConfig) (int, error) {
+	f := s.f
+	err := f.call(ctx, "Disks.Create")
+	defer f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	if err := f.checkQuota(diskConfig.AccountID, diskConfig.Size); err != nil {
+		return 0, err
+	}
+	id := f.nextID()
+	f.disks[id] = &ovc.DiskInfo{
+		ID:        id,
+		AccountID: diskConfig.AccountID,
+		GridID:    diskConfig.GridID,
+		Name:      diskConfig.Name,
+		Descr:     diskConfig.Description,
+		SizeMax:   diskConfig.Size,
+		Type:      diskConfig.Type,
+		Status:    "CREATED",
+		Iotune:    ovc.IOTune{TotalIopsSec: diskConfig.IOPS},
+	}
+	return id, nil
+}
+
+func (s *fakeDiskService) Attach(ctx context.Context, attachConfig *ovc.DiskAttachConfig) error {
+	f := s.f
+	err := f.call(ctx, "Disks.Attach")
+	defer f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if _, ok := f.disks[attachConfig.DiskID]; !ok {
+		return errNotFound("disk", attachConfig.DiskID)
+	}
+	if _, ok := f.machines[attachConfig.MachineID]; !ok {
+		return errNotFound("machine", attachConfig.MachineID)
+	}
+	if machineID, ok := f.attachments[attachConfig.DiskID]; ok {
+		return fmt.Errorf("disk %d is already attached to machine %d", attachConfig.DiskID, machineID)
+	}
+	f.attachments[attachConfig.DiskID] = attachConfig.MachineID
+	f.disks[attachConfig.DiskID].PCISlot = f.freePCISlot(attachConfig.MachineID)
+	return nil
+}
+
+// freePCISlot returns the lowest PCI slot not used by the disks attached to a
+// machine
+func (f *fakeOVC) freePCISlot(machineID int) int {
+	used := make(map[int]bool)
+	for diskID, attachedTo := range f.attachments {
+		if attachedTo == machineID {
+			used[f.disks[diskID].PCISlot] = true
+		}
+	}
+	slot := fakeFirstPCISlot
+	for used[slot] {
+		slot++
+	}
+	return slot
+}
+
+func (s *fakeDiskService) Detach(ctx context.Context, attachConfig *ovc.DiskAttachConfig) error {
+	f := s.f
+	err := f.call(ctx, "Disks.Detach")
+	defer f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if machineID, ok := f.attachments[attachConfig.DiskID]; !ok || machineID != attachConfig.MachineID {
+		return fmt.Errorf("disk %d is not attached to machine %d", attachConfig.DiskID, attachConfig.MachineID)
+	}
+	delete(f.attachments, attachConfig.DiskID)
+	f.disks[attachConfig.DiskID].PCISlot = 0
+	return nil
+}
+
+func (s *fakeDiskService) Delete(ctx context.Context, deleteConfig *ovc.DiskDeleteConfig) error {
+	f := s.f
+	err := f.call(ctx, "Disks.Delete")
+	defer f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if _, ok := f.disks[deleteConfig.DiskID]; !ok {
+		return errNotFound("disk", deleteConfig.DiskID)
+	}
+	if _, ok := f.attachments[deleteConfig.DiskID]; ok {
+		if !deleteConfig.Detach {
+			return fmt.Errorf("disk %d is attached to a machine", deleteConfig.DiskID)
+		}
+		delete(f.attachments, deleteConfig.DiskID)
+	}
+	delete(f.disks, deleteConfig.DiskID)
+	return nil
+}
+
+func (s *fakeDiskService) Resize(ctx context.Context, diskConfig *ovc.DiskConfig) error {
+	f := s.f
+	err := f.call(ctx, "Disks.Resize")
+	defer f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	disk, ok := f.disks[diskConfig.DiskID]
+	if !ok {
+		return errNotFound("disk", diskConfig.DiskID)
+	}
+	if diskConfig.Size < disk.SizeMax {
+		return fmt.Errorf("disk %d can not be shrunk", diskConfig.DiskID)
+	}
+	if err := f.checkQuota(disk.AccountID, diskConfig.Size-disk.SizeMax); err != nil {
+		return err
+	}
+	disk.SizeMax = diskConfig.Size
+	return nil
+}
+
+type fakeMachineService struct{ f *fakeOVC }
+
+func (s *fakeMachineService) List(ctx context.Context, cloudspaceID int) (*[]ovc.Machine, error) {
+	f := s.f
+	err := f.call(ctx, "Machines.List")
+	defer f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	machines := []ovc.Machine{}
+	for _, machine := range f.machines {
+		if machine.cloudspaceID != cloudspaceID {
+			continue
+		}
+		machines = append(machines, ovc.Machine{
+			ID:          machine.id,
+			ReferenceID: machine.referenceID,
+			Status:      machine.status,
+			Disks:       f.machineDisks(machine.id),
+		})
+	}
+	return &machines, nil
+}
+
+func (s *fakeMachineService) Get(ctx context.Context, machineID int) (*ovc.MachineInfo, error) {
+	f := s.f
+	err := f.call(ctx, "Machines.Get")
+	defer f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	machine, ok := f.machines[machineID]
+	if !ok {
+		return nil, errNotFound("machine", machineID)
+	}
+	return f.machineInfo(machine), nil
+}
+
+func (s *fakeMachineService) GetByReferenceID(ctx context.Context, referenceID string) (*ovc.MachineInfo, error) {
+	f := s.f
+	err := f.call(ctx, "Machines.GetByReferenceID")
+	defer f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	for _, machine := range f.machines {
+		if machine.referenceID == referenceID {
+			return f.machineInfo(machine), nil
+		}
+	}
+	return nil, errNotFound("machine with reference ID", referenceID)
+}
+
+func (s *fakeMachineService) Stop(ctx context.Context, machineID int, force bool) error {
+	f := s.f
+	err := f.call(ctx, "Machines.Stop")
+	defer f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	machine, ok := f.machines[machineID]
+	if !ok {
+		return errNotFound("machine", machineID)
+	}
+	machine.status = "HALTED"
+	return nil
+}
+
+func (f *fakeOVC) machineDisks(machineID int) []int {
+	disks := []int{}
+	for diskID, attachedTo := range f.attachments {
+		if attachedTo == machineID {
+			disks = append(disks, diskID)
+		}
+	}
+	return disks
+}
+
+func (f *fakeOVC) machineInfo(machine *fakeMachine) *ovc.MachineInfo {
+	info := &ovc.MachineInfo{
+		ID:           machine.id,
+		CloudspaceID: machine.cloudspaceID,
+		Status:       machine.status,
+	}
+	for _, diskID := range f.machineDisks(machine.id) {
+		info.Disks = append(info.Disks, ovc.MachineDisk{ID: diskID})
+	}
+	return info
+}
+
+type fakeAccountService struct{ f *fakeOVC }
+
+func (s *fakeAccountService) GetIDByName(ctx context.Context, name string) (int, error) {
+	f := s.f
+	err := f.call(ctx, "Accounts.GetIDByName")
+	defer f.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	for id, account := range f.accounts {
+		if account.Name == name {
+			return id, nil
+		}
+	}
+	return 0, status.Errorf(codes.NotFound, "account %s not found", name)
+}
+
+func (s *fakeAccountService) Get(ctx context.Context, accountID int) (*AccountDetails, error) {
+	f := s.f
+	err := f.call(ctx, "Accounts.Get")
+	defer f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	account, ok := f.accounts[accountID]
+	if !ok {
+		return nil, errNotFound("account", accountID)
+	}
+	accountCopy := *account
+	return &accountCopy, nil
+}
+
+type fakeCloudSpaceService struct{ f *fakeOVC }
+
+func (s *fakeCloudSpaceService) List(ctx context.Context) (*[]ovc.CloudSpaceInfo, error) {
+	f := s.f
+	err := f.call(ctx, "CloudSpaces.List")
+	defer f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	cloudspaces := []ovc.CloudSpaceInfo{}
+	for _, cloudspace := range f.cloudspaces {
+		cloudspaces = append(cloudspaces, ovc.CloudSpaceInfo{
+			ID:        cloudspace.ID,
+			AccountID: cloudspace.AccountID,
+			GridID:    cloudspace.GridID,
+			Location:  cloudspace.Location,
+		})
+	}
+	return &cloudspaces, nil
+}
+
+func (s *fakeCloudSpaceService) Get(ctx context.Context, cloudspaceID int) (*ovc.CloudSpace, error) {
+	f := s.f
+	err := f.call(ctx, "CloudSpaces.Get")
+	defer f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	cloudspace, ok := f.cloudspaces[cloudspaceID]
+	if !ok {
+		return nil, errNotFound("cloudspace", cloudspaceID)
+	}
+	cloudspaceCopy := *cloudspace
+	return &cloudspaceCopy, nil
+}
+
+type fakeLocationService struct{ f *fakeOVC }
+
+func (s *fakeLocationService) List(ctx context.Context) (*ovc.LocationList, error) {
+	f := s.f
+	err := f.call(ctx, "Locations.List")
+	defer f.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	locations := append(ovc.LocationList{}, f.locations...)
+	return &locations, nil
+}
+
+type fakeJWT struct{ f *fakeOVC }
+
+func (s *fakeJWT) Get(ctx context.Context) (string, error) {
+	f := s.f
+	err := f.call(ctx, "JWT.Get")
+	defer f.mu.Unlock()
+	if err != nil {
+		return "", err
+	}
+	// Like the SDK, return the JWT with an error once it expired
+	if expiry, ok, _ := jwtExpiry(f.jwt); ok && time.Now().After(expiry) {
+		return f.jwt, ovc.ErrExpiredJWT
+	}
+	return f.jwt, nil
+}
+
+func (s *fakeJWT) Set(jwt string) error {
+	f := s.f
+	err := f.call(context.Background(), "JWT.Set")
+	defer f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	f.jwt = jwt
+	return nil
+}
@@ -0,0 +1,231 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+// defaultGCGracePeriod is how long a disk is orphaned before the garbage
+// collector deletes it by default
+const defaultGCGracePeriod = 24 * time.Hour
+
+// clusterVolumes holds the volume handles and names of the PersistentVolumes
+// of the driver in the cluster
+type clusterVolumes struct {
+	handles map[string]bool
+	names   map[string]bool
+}
+
+// garbageCollector finds the disks the driver created for the cluster that
+// no PersistentVolume refers to, like disks of provisions that failed after
+// the disk was created. They are reported and deleted once they are orphaned
+// for the grace period, unless it runs in dry run mode.
+type garbageCollector struct {
+	interval    time.Duration
+	gracePeriod time.Duration
+	dryRun      bool
+	// volumes lists the PersistentVolumes of the driver in the cluster
+	volumes func() (*clusterVolumes, error)
+	now     func() time.Time
+
+	// orphanedSince holds when disks were first found orphaned
+	orphanedSince map[int]time.Time
+	// done is closed when the garbage collector stopped
+	done chan struct{}
+}
+
+func newGarbageCollector(config *Config, volumes func() (*clusterVolumes, error)) *garbageCollector {
+	gracePeriod := config.GCGracePeriod
+	if gracePeriod == 0 {
+		gracePeriod = defaultGCGracePeriod
+	}
+	return &garbageCollector{
+		interval:      config.GCInterval,
+		gracePeriod:   gracePeriod,
+		dryRun:        config.GCDryRun,
+		volumes:       volumes,
+		now:           time.Now,
+		orphanedSince: make(map[int]time.Time),
+		done:          make(chan struct{}),
+	}
+}
+
+// kubeVolumeLister returns a function listing the PersistentVolumes of the
+// driver with the in-cluster Kubernetes config
+func kubeVolumeLister() (func() (*clusterVolumes, error), error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load in-cluster Kubernetes config: %s", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() (*clusterVolumes, error) {
+		pvs, err := clientset.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return driverVolumes(pvs.Items), nil
+	}, nil
+}
+
+// driverVolumes returns the volumes of the PersistentVolumes of the driver
+func driverVolumes(pvs []v1.PersistentVolume) *clusterVolumes {
+	volumes := &clusterVolumes{
+		handles: make(map[string]bool),
+		names:   make(map[string]bool),
+	}
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != driverName {
+			continue
+		}
+		volumes.handles[pv.Spec.CSI.VolumeHandle] = true
+		volumes.names[pv.Name] = true
+	}
+	return volumes
+}
+
+// runGarbageCollector collects orphaned disks every interval until the
+// driver stops
+func (d *Driver) runGarbageCollector(ctx context.Context) {
+	defer close(d.gc.done)
+	ticker := time.NewTicker(d.gc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+		}
+
+		if err := d.collectGarbage(ctx); err != nil {
+			d.log.Warningf("Failed to collect orphaned disks: %s", err)
+		}
+	}
+}
+
+// collectGarbage reports the disks of the account of the driver that were
+// created for the cluster and that no PersistentVolume refers to, and deletes
+// the ones that are orphaned for the grace period. Disks created before the
+// cluster ID was stored on them are never collected, nor are the disks of
+// accounts configured with StorageClass secrets, as the controller doesn't
+// know their credentials until a request refers to them.
+func (d *Driver) collectGarbage(ctx context.Context) error {
+	gc := d.gc
+	volumes, err := gc.volumes()
+	if err != nil {
+		return fmt.Errorf("failed to list PersistentVolumes: %s", err)
+	}
+	disks, err := d.defaultTenant().listVolumes(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := gc.now()
+	orphanedSince := make(map[int]time.Time)
+	for _, disk := range disks {
+		owned, metadata := parseDiskDescription(disk.Description)
+		if !owned || metadata == nil || metadata.Cluster != d.clusterID {
+			continue
+		}
+		if volumes.handles[strconv.Itoa(disk.ID)] || volumes.names[metadata.PVName] {
+			continue
+		}
+
+		since, seen := gc.orphanedSince[disk.ID]
+		if !seen {
+			since = now
+		}
+		orphanedSince[disk.ID] = since
+
+		ll := d.log.WithFields(logrus.Fields{
+			"disk_id":        disk.ID,
+			"pv_name":        metadata.PVName,
+			"orphaned_since": since.Format(time.RFC3339),
+			"method":         "collect_garbage",
+		})
+		switch {
+		case now.Sub(since) < gc.gracePeriod:
+			if !seen {
+				ll.Warningf("Disk %d of PersistentVolume %s is orphaned, it will be deleted after %s", disk.ID, metadata.PVName, gc.gracePeriod)
+			}
+		case gc.dryRun:
+			ll.Warningf("Disk %d of PersistentVolume %s is orphaned, not deleting it in dry run mode", disk.ID, metadata.PVName)
+		default:
+			if err := d.deleteOrphanedDisk(ctx, disk.ID, metadata, since, ll); err != nil {
+				ll.Errorf("Failed to delete orphaned disk %d: %s", disk.ID, err)
+				continue
+			}
+			delete(orphanedSince, disk.ID)
+		}
+	}
+
+	gc.orphanedSince = orphanedSince
+	d.metrics.orphanedDisks.Set(float64(len(orphanedSince)))
+	return nil
+}
+
+// deleteOrphanedDisk deletes an orphaned disk, unless it is attached to a
+// machine. The inventory can be a resync old, so whether the disk is attached
+// is checked with the OVC API: the machine the inventory holds is verified,
+// and the inventory is reconciled first if it holds none.
+func (d *Driver) deleteOrphanedDisk(ctx context.Context, diskID int, metadata *diskMetadata, since time.Time, ll *logrus.Entry) error {
+	unlock := d.attacher.lockDisk(diskID)
+	defer unlock()
+	machine, err := d.attacher.verifiedAttachment(diskID)
+	if err == nil && machine == nil {
+		machine, err = d.attacher.unlistedAttachment(diskID, 0)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check whether the disk is attached: %s", err)
+	}
+	if machine != nil {
+		return fmt.Errorf("disk is attached to machine %d", machine.ID)
+	}
+
+	err = d.client.Disks.Delete(ctx, &ovc.DiskDeleteConfig{
+		DiskID:      diskID,
+		Permanently: true,
+	})
+	if err != nil {
+		listed, listErr := d.defaultTenant().diskListed(ctx, diskID)
+		if listErr != nil || listed {
+			return err
+		}
+	}
+	d.attacher.forget(diskID)
+	d.metrics.deletedDisks.Inc()
+
+	ll.Infof("Deleted orphaned disk %d of PersistentVolume %s", diskID, metadata.PVName)
+	d.attacherConfig.events.Eventf(v1.EventTypeNormal, "DeletedOrphanedDisk", "Deleted disk %d of PersistentVolume %s, which was orphaned since %s",
+		diskID, metadata.PVName, since.Format(time.RFC3339))
+	return nil
+}
@@ -0,0 +1,186 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testClusterID = "cluster-1"
+
+// addClusterDisk adds a disk created by the driver for a PersistentVolume of
+// the given cluster
+func addClusterDisk(f *fakeOVC, clusterID, pvName string) int {
+	diskID := f.addDisk(f.accountID(), pvName, 10)
+	f.setDiskDescription(diskID, (&diskMetadata{Cluster: clusterID, PVName: pvName}).description())
+	return diskID
+}
+
+func TestCollectGarbage(t *testing.T) {
+	tt := []struct {
+		name string
+		// setup adds a disk and returns its ID
+		setup    func(f *fakeOVC, d *Driver, volumes *clusterVolumes) int
+		dryRun   bool
+		orphaned float64
+		deleted  bool
+	}{
+		{
+			name: "volume of the cluster",
+			setup: func(f *fakeOVC, d *Driver, volumes *clusterVolumes) int {
+				diskID := addClusterDisk(f, testClusterID, "pvc-1")
+				volumes.handles[strconv.Itoa(diskID)] = true
+				return diskID
+			},
+		},
+		{
+			name: "volume being provisioned",
+			setup: func(f *fakeOVC, d *Driver, volumes *clusterVolumes) int {
+				volumes.names["pvc-1"] = true
+				return addClusterDisk(f, testClusterID, "pvc-1")
+			},
+		},
+		{
+			name: "orphaned volume",
+			setup: func(f *fakeOVC, d *Driver, volumes *clusterVolumes) int {
+				return addClusterDisk(f, testClusterID, "pvc-1")
+			},
+			deleted: true,
+		},
+		{
+			name: "orphaned volume in dry run mode",
+			setup: func(f *fakeOVC, d *Driver, volumes *clusterVolumes) int {
+				return addClusterDisk(f, testClusterID, "pvc-1")
+			},
+			dryRun:   true,
+			orphaned: 1,
+		},
+		{
+			name: "attached orphaned volume",
+			setup: func(f *fakeOVC, d *Driver, volumes *clusterVolumes) int {
+				diskID := addClusterDisk(f, testClusterID, "pvc-1")
+				machineID := f.addMachine(f.addCloudSpace(f.accountID(), -1))
+				f.attachDisk(diskID, machineID)
+				d.attacher.setAttached(diskID, machineID)
+				return diskID
+			},
+			orphaned: 1,
+		},
+		{
+			name: "orphaned volume attached since the last resync",
+			setup: func(f *fakeOVC, d *Driver, volumes *clusterVolumes) int {
+				diskID := addClusterDisk(f, testClusterID, "pvc-1")
+				machineID := f.addMachine(f.addCloudSpace(f.accountID(), -1))
+				f.attachDisk(diskID, machineID)
+				return diskID
+			},
+			orphaned: 1,
+		},
+		{
+			name: "volume of another cluster",
+			setup: func(f *fakeOVC, d *Driver, volumes *clusterVolumes) int {
+				return addClusterDisk(f, "cluster-2", "pvc-1")
+			},
+		},
+		{
+			name: "volume without metadata",
+			setup: func(f *fakeOVC, d *Driver, volumes *clusterVolumes) int {
+				diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+				f.setDiskDescription(diskID, createdByGig)
+				return diskID
+			},
+		},
+		{
+			name: "disk not created by the driver",
+			setup: func(f *fakeOVC, d *Driver, volumes *clusterVolumes) int {
+				return f.addDisk(f.accountID(), "pvc-1", 10)
+			},
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			d := newGCTestDriver(t, f, tc.dryRun)
+			volumes := driverVolumes(nil)
+			d.gc.volumes = func() (*clusterVolumes, error) {
+				return volumes, nil
+			}
+			diskID := tc.setup(f, d, volumes)
+
+			// Nothing is deleted within the grace period
+			require.NoError(t, d.collectGarbage(context.Background()))
+			require.NotNil(t, f.disk(diskID))
+
+			now := time.Now().Add(2 * time.Hour)
+			d.gc.now = func() time.Time { return now }
+			require.NoError(t, d.collectGarbage(context.Background()))
+			require.Equal(t, tc.deleted, f.disk(diskID) == nil)
+			if !tc.deleted {
+				require.Zero(t, f.callCount("Disks.Delete"))
+			}
+			require.Equal(t, tc.orphaned, testutil.ToFloat64(d.metrics.orphanedDisks))
+		})
+	}
+}
+
+func TestCollectGarbageWithoutVolumes(t *testing.T) {
+	f := newFakeOVC()
+	d := newGCTestDriver(t, f, false)
+	d.gc.volumes = func() (*clusterVolumes, error) {
+		return nil, errors.New("forbidden")
+	}
+	diskID := addClusterDisk(f, testClusterID, "pvc-1")
+	d.gc.orphanedSince[diskID] = time.Now().Add(-48 * time.Hour)
+
+	require.Error(t, d.collectGarbage(context.Background()))
+	require.NotNil(t, f.disk(diskID))
+}
+
+func TestDriverVolumes(t *testing.T) {
+	pv := func(name, driver, handle string) v1.PersistentVolume {
+		pv := v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: name}}
+		if driver != "" {
+			pv.Spec.CSI = &v1.CSIPersistentVolumeSource{Driver: driver, VolumeHandle: handle}
+		}
+		return pv
+	}
+
+	volumes := driverVolumes([]v1.PersistentVolume{
+		pv("pvc-1", driverName, "1"),
+		pv("pvc-2", "other.csi.driver", "2"),
+		pv("pvc-3", "", ""),
+	})
+	require.Equal(t, map[string]bool{"1": true}, volumes.handles)
+	require.Equal(t, map[string]bool{"pvc-1": true}, volumes.names)
+}
+
+func TestGarbageCollectorRequiresClusterID(t *testing.T) {
+	_, err := newDriver(&Config{
+		Account:    fakeAccountName,
+		Mode:       ControllerMode,
+		GCInterval: time.Hour,
+	}, newFakeOVC().client())
+	require.Error(t, err)
+}
+
+// newGCTestDriver returns a controller driver with a garbage collector with
+// a grace period of an hour
+func newGCTestDriver(t *testing.T, f *fakeOVC, dryRun bool) *Driver {
+	d := newTestDriver(t, f)
+	d.clusterID = testClusterID
+	d.gc = newGarbageCollector(&Config{
+		GCInterval:    time.Hour,
+		GCGracePeriod: time.Hour,
+		GCDryRun:      dryRun,
+	}, nil)
+	go d.runGarbageCollector(context.Background())
+	return d
+}
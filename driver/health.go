@@ -0,0 +1,120 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthCheckInterval is how long the result of checking the OVC API is
+// cached, so frequent probes don't load the API
+const healthCheckInterval = 30 * time.Second
+
+// health caches the result of the last check of the OVC API
+type health struct {
+	mu        sync.Mutex
+	checkedAt time.Time
+	err       error
+}
+
+// checkReadiness returns why the plugin can't serve requests, if so. An
+// expired JWT only fails readiness: the JWT file is reloaded without a
+// restart, and the node service doesn't need the API to unmount volumes.
+func (d *Driver) checkReadiness(ctx context.Context) error {
+	if err := d.checkAPI(ctx); err != nil {
+		return err
+	}
+	if err := d.jwtExpired(); err != nil {
+		return err
+	}
+	return d.checkLiveness()
+}
+
+// checkLiveness returns why the plugin needs to be restarted, if so. Neither
+// an unreachable OVC API nor an expired JWT fail the check, restarting
+// doesn't help then.
+func (d *Driver) checkLiveness() error {
+	if d.attacher != nil {
+		if err := d.attacher.healthy(); err != nil {
+			return err
+		}
+	}
+	for _, a := range d.tenantAttachers() {
+		if err := a.healthy(); err != nil {
+			return fmt.Errorf("attacher of account %d: %s", a.accountID, err)
+		}
+	}
+	return nil
+}
+
+// checkAPI checks that the JWT is valid and the OVC API can be reached. The
+// result is cached for healthCheckInterval.
+func (d *Driver) checkAPI(ctx context.Context) error {
+	d.health.mu.Lock()
+	defer d.health.mu.Unlock()
+	if time.Since(d.health.checkedAt) < healthCheckInterval {
+		return d.health.err
+	}
+
+	err := d.checkJWT(ctx)
+	if err == nil {
+		if _, err = d.client.Locations.List(ctx); err != nil {
+			err = fmt.Errorf("OVC API can't be reached: %s", err)
+		}
+	}
+	if ctx.Err() != nil {
+		// Don't cache the result of a check that was canceled by the caller
+		return err
+	}
+	d.health.checkedAt = time.Now()
+	d.health.err = err
+	return err
+}
+
+// serveHealthz serves the liveness of the plugin at /healthz the way the
+// livenessprobe sidecar does: 200 if the plugin is healthy, 500 with the
+// reason if it should be restarted
+func (d *Driver) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	if err := d.checkLiveness(); err != nil {
+		d.log.WithField("method", "healthz").Errorf("Health check failed: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// serveHealth serves the health endpoint in the background
+func (d *Driver) serveHealth() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", d.serveHealthz)
+	d.healthSrv = &http.Server{
+		Addr:    d.healthAddress,
+		Handler: mux,
+	}
+	d.log.Infof("Serving health endpoint on address: %s", d.healthAddress)
+	go func() {
+		if err := d.healthSrv.ListenAndServe(); err != http.ErrServerClosed {
+			d.log.Errorf("Health server failed: %s", err)
+		}
+	}()
+}
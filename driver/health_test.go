@@ -0,0 +1,107 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	tt := []struct {
+		name  string
+		setup func(t *testing.T, f *fakeOVC, d *Driver)
+		ready bool
+		live  bool
+	}{
+		{
+			name:  "healthy",
+			setup: func(t *testing.T, f *fakeOVC, d *Driver) {},
+			ready: true,
+			live:  true,
+		},
+		{
+			name: "API failing",
+			setup: func(t *testing.T, f *fakeOVC, d *Driver) {
+				f.failOn("Locations.List", errors.New("403 Forbidden"))
+			},
+			ready: false,
+			live:  true,
+		},
+		{
+			name: "JWT expired",
+			setup: func(t *testing.T, f *fakeOVC, d *Driver) {
+				f.jwt = newFakeJWT(time.Now().Add(-time.Minute))
+			},
+			ready: false,
+			live:  true,
+		},
+		{
+			name: "attacher stuck",
+			setup: func(t *testing.T, f *fakeOVC, d *Driver) {
+				cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+				machineID := f.addMachine(cloudspaceID)
+				diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+
+				var mu sync.Mutex
+				now := time.Now()
+				d.attacher.now = func() time.Time {
+					mu.Lock()
+					defer mu.Unlock()
+					return now
+				}
+				release := f.hold("Disks.Attach")
+				t.Cleanup(release)
+				async(func() error {
+					return d.attacher.attach(context.Background(), diskID, machineID)
+				})
+				waitFor(t, func() bool { return f.callCount("Disks.Attach") == 1 })
+
+				mu.Lock()
+				now = now.Add(attachStuckTimeout + time.Minute)
+				mu.Unlock()
+			},
+			ready: false,
+			live:  false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			d := newTestDriver(t, f)
+			tc.setup(t, f, d)
+
+			resp, err := d.Probe(context.Background(), &csi.ProbeRequest{})
+			require.NoError(t, err)
+			require.Equal(t, tc.ready, resp.Ready.Value)
+
+			rec := httptest.NewRecorder()
+			d.serveHealthz(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if tc.live {
+				require.Equal(t, http.StatusOK, rec.Code)
+			} else {
+				require.Equal(t, http.StatusInternalServerError, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestProbeCachesAPICheck(t *testing.T) {
+	f := newFakeOVC()
+	d := newTestDriver(t, f)
+	calls := f.callCount("Locations.List")
+
+	for i := 0; i < 3; i++ {
+		resp, err := d.Probe(context.Background(), &csi.ProbeRequest{})
+		require.NoError(t, err)
+		require.True(t, resp.Ready.Value)
+	}
+	require.Equal(t, calls+1, f.callCount("Locations.List"))
+}
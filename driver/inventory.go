@@ -0,0 +1,165 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// defaultInventoryResync is the default interval at which the inventory of
+// attached disks is reconciled with the OVC API
+const defaultInventoryResync = 5 * time.Minute
+
+// inventory caches the machine every disk of the account is attached to.
+// It is updated by the attacher after every attach and detach and
+// reconciled periodically with the OVC API, as disks can be attached and
+// detached outside of the driver, e.g. in the OVC portal.
+type inventory struct {
+	mu    sync.Mutex
+	disks map[int]int
+	// seq is incremented on every local change, changed holds the sequence
+	// number of the last local change per disk. A reconciliation keeps the
+	// changes made while it was listing the machines.
+	seq          uint64
+	changed      map[int]uint64
+	reconciledAt time.Time
+}
+
+// inventoryChange is a difference between the inventory and the OVC API
+// found while reconciling, a machine ID of 0 means not attached
+type inventoryChange struct {
+	diskID int
+	from   int
+	to     int
+}
+
+func newInventory() *inventory {
+	return &inventory{
+		disks:   make(map[int]int),
+		changed: make(map[int]uint64),
+	}
+}
+
+// get returns the machine a disk is attached to
+func (inv *inventory) get(diskID int) (int, bool) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	machineID, ok := inv.disks[diskID]
+	return machineID, ok
+}
+
+// size returns the number of attached disks
+func (inv *inventory) size() int {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return len(inv.disks)
+}
+
+// set records that a disk is attached to a machine
+func (inv *inventory) set(diskID, machineID int) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	inv.disks[diskID] = machineID
+	inv.touch(diskID)
+}
+
+// forget records that a disk isn't attached to any machine
+func (inv *inventory) forget(diskID int) {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	delete(inv.disks, diskID)
+	inv.touch(diskID)
+}
+
+func (inv *inventory) touch(diskID int) {
+	inv.seq++
+	inv.changed[diskID] = inv.seq
+}
+
+// begin returns the sequence number to pass to reconcile for a listing that
+// starts now
+func (inv *inventory) begin() uint64 {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	return inv.seq
+}
+
+// reconcile replaces the inventory by the attachments listed from the OVC
+// API after sequence number since, except for the disks changed locally in
+// the meantime. It returns the differences with the previous inventory,
+// which are none for the first reconciliation.
+func (inv *inventory) reconcile(disks map[int]int, since uint64) []inventoryChange {
+	inv.mu.Lock()
+	defer inv.mu.Unlock()
+	first := inv.reconciledAt.IsZero()
+
+	for diskID, seq := range inv.changed {
+		if seq <= since {
+			delete(inv.changed, diskID)
+			continue
+		}
+		if machineID, ok := inv.disks[diskID]; ok {
+			disks[diskID] = machineID
+		} else {
+			delete(disks, diskID)
+		}
+	}
+
+	if first {
+		inv.disks = disks
+		inv.reconciledAt = time.Now()
+		return nil
+	}
+
+	var changes []inventoryChange
+	for diskID, machineID := range disks {
+		if inv.disks[diskID] != machineID {
+			changes = append(changes, inventoryChange{diskID: diskID, from: inv.disks[diskID], to: machineID})
+		}
+	}
+	for diskID, machineID := range inv.disks {
+		if _, ok := disks[diskID]; !ok {
+			changes = append(changes, inventoryChange{diskID: diskID, from: machineID})
+		}
+	}
+
+	inv.disks = disks
+	inv.reconciledAt = time.Now()
+	return changes
+}
+
+// ServeHTTP writes the contents of the inventory as JSON
+func (inv *inventory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	inv.mu.Lock()
+	contents := struct {
+		ReconciledAt time.Time   `json:"reconciledAt"`
+		Disks        map[int]int `json:"disks"`
+	}{
+		ReconciledAt: inv.reconciledAt,
+		Disks:        make(map[int]int, len(inv.disks)),
+	}
+	for diskID, machineID := range inv.disks {
+		contents.Disks[diskID] = machineID
+	}
+	inv.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(contents)
+}
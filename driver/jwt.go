@@ -0,0 +1,199 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	jwtLib "github.com/dgrijalva/jwt-go"
+)
+
+const (
+	// jwtCheckInterval is how often the JWT is checked for expiry, which
+	// refreshes it if it's about to expire, and the JWT file for changes.
+	// Kubelet updates mounted secrets about once a minute.
+	jwtCheckInterval = 30 * time.Second
+	// jwtExpiryWarning is how long before the JWT expires warnings are
+	// logged
+	jwtExpiryWarning = 24 * time.Hour
+	// jwtLogInterval limits how often the same warning about the JWT is
+	// logged
+	jwtLogInterval = time.Hour
+	// jwtRenewBefore is how long before a JWT fetched with client
+	// credentials expires a new one is fetched. The SDK refuses to use a
+	// JWT in the last 5 minutes before it expires.
+	jwtRenewBefore = 10 * time.Minute
+)
+
+// jwtState tracks the JWT the driver authenticates with
+type jwtState struct {
+	mu     sync.Mutex
+	expiry time.Time
+
+	// file is the path the JWT is loaded from, loaded is its content when
+	// it was last loaded. They are only used by the JWT maintainer.
+	file   string
+	loaded string
+	// loggedAt is when a warning about the JWT was last logged
+	loggedAt time.Time
+	// renewed is true if the JWT is fetched with client credentials, so it
+	// doesn't need to be rotated by hand
+	renewed bool
+}
+
+// readJWTFile reads a JWT from a file, like a mounted secret
+func readJWTFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read JWT file: %s", err)
+	}
+	jwt := strings.TrimSpace(string(content))
+	if jwt == "" {
+		return "", fmt.Errorf("JWT file %s is empty", path)
+	}
+	return jwt, nil
+}
+
+// jwtExpiry returns the expiry time of a JWT, ok is false if it doesn't
+// expire. The signature isn't verified, that's up to the OVC SDK.
+func jwtExpiry(jwt string) (expiry time.Time, ok bool, err error) {
+	claims := jwtLib.MapClaims{}
+	if _, _, err := new(jwtLib.Parser).ParseUnverified(jwt, claims); err != nil {
+		return time.Time{}, false, err
+	}
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return time.Time{}, false, nil
+	}
+	return time.Unix(int64(exp), 0), true, nil
+}
+
+// jwtExpiresWithin returns true if the JWT expires within d
+func jwtExpiresWithin(jwt string, d time.Duration) bool {
+	expiry, ok, err := jwtExpiry(jwt)
+	return err == nil && ok && time.Until(expiry) < d
+}
+
+// checkJWT fetches the JWT, which refreshes it if it's about to expire and
+// is refreshable, and records its expiry time
+func (d *Driver) checkJWT(ctx context.Context) error {
+	jwt, err := d.client.JWT.Get(ctx)
+	if jwt == "" {
+		return fmt.Errorf("JWT is not valid: %s", err)
+	}
+
+	expiry, ok, parseErr := jwtExpiry(jwt)
+	if parseErr != nil {
+		return fmt.Errorf("JWT can't be parsed: %s", parseErr)
+	}
+	if ok {
+		d.jwt.mu.Lock()
+		changed := !expiry.Equal(d.jwt.expiry)
+		d.jwt.expiry = expiry
+		d.jwt.mu.Unlock()
+		if changed {
+			d.log.Infof("Using JWT which expires at %s", expiry.Format(time.RFC3339))
+		}
+	}
+	if expiredErr := d.jwtExpired(); expiredErr != nil {
+		return expiredErr
+	}
+	if err != nil {
+		return fmt.Errorf("JWT is not valid: %s", err)
+	}
+	return nil
+}
+
+// jwtExpired returns an error if the JWT expired when it was last checked
+func (d *Driver) jwtExpired() error {
+	d.jwt.mu.Lock()
+	expiry := d.jwt.expiry
+	d.jwt.mu.Unlock()
+	if !expiry.IsZero() && time.Now().After(expiry) {
+		return fmt.Errorf("JWT expired at %s", expiry.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// reloadJWTFile loads the JWT from the JWT file if it changed
+func (d *Driver) reloadJWTFile() error {
+	jwt, err := readJWTFile(d.jwt.file)
+	if err != nil {
+		return err
+	}
+	if jwt == d.jwt.loaded {
+		return nil
+	}
+	if err := d.client.JWT.Set(jwt); err != nil {
+		return fmt.Errorf("failed to load JWT from %s: %s", d.jwt.file, err)
+	}
+	d.jwt.loaded = jwt
+	d.log.Infof("Loaded rotated JWT from %s", d.jwt.file)
+
+	// Check the OVC API with the new JWT on the next probe
+	d.health.mu.Lock()
+	d.health.checkedAt = time.Time{}
+	d.health.mu.Unlock()
+	return nil
+}
+
+// maintainJWT reloads the JWT file when it changes and keeps the JWT
+// refreshed until the driver stops. Problems are logged at most once per
+// jwtLogInterval.
+func (d *Driver) maintainJWT(ctx context.Context) {
+	defer close(d.jwtMaintainerDone)
+	ticker := time.NewTicker(jwtCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.quit:
+			return
+		case <-ticker.C:
+		}
+
+		if d.jwt.file != "" {
+			if err := d.reloadJWTFile(); err != nil {
+				d.logJWTWarning("Failed to reload the JWT: %s", err)
+			}
+		}
+		if err := d.checkJWT(ctx); err != nil {
+			d.logJWTWarning("%s, refresh the JWT of the driver", err)
+			continue
+		}
+
+		d.jwt.mu.Lock()
+		expiry := d.jwt.expiry
+		d.jwt.mu.Unlock()
+		if !d.jwt.renewed && !expiry.IsZero() && time.Until(expiry) < jwtExpiryWarning {
+			d.logJWTWarning("JWT expires at %s, refresh the JWT of the driver", expiry.Format(time.RFC3339))
+		}
+	}
+}
+
+func (d *Driver) logJWTWarning(format string, args ...interface{}) {
+	if time.Since(d.jwt.loggedAt) < jwtLogInterval {
+		return
+	}
+	d.jwt.loggedAt = time.Now()
+	d.log.Warningf(format, args...)
+}
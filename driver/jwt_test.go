@@ -0,0 +1,201 @@
+package driver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jwtLib "github.com/dgrijalva/jwt-go"
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestJWTFileRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ovc-csi-jwt")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	jwtFile := filepath.Join(dir, "client_jwt")
+
+	f := newFakeOVC()
+	require.NoError(t, ioutil.WriteFile(jwtFile, []byte(f.jwt+"\n"), 0600))
+	d, err := newDriver(&Config{
+		Account: fakeAccountName,
+		Mode:    ControllerMode,
+		JWTFile: jwtFile,
+	}, f.client())
+	require.NoError(t, err)
+	t.Cleanup(d.Stop)
+	currentJWT := func() string {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.jwt
+	}
+
+	// Unchanged file
+	require.NoError(t, d.reloadJWTFile())
+	require.Zero(t, f.callCount("JWT.Set"))
+
+	// Rotated JWT
+	expiry := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	rotated := newFakeJWT(expiry)
+	require.NoError(t, ioutil.WriteFile(jwtFile, []byte(rotated), 0600))
+	require.NoError(t, d.reloadJWTFile())
+	require.Equal(t, rotated, currentJWT())
+	require.NoError(t, d.checkJWT(context.Background()))
+	d.jwt.mu.Lock()
+	require.Equal(t, expiry, d.jwt.expiry)
+	d.jwt.mu.Unlock()
+
+	// Empty file while the secret is being updated
+	require.NoError(t, ioutil.WriteFile(jwtFile, nil, 0600))
+	require.Error(t, d.reloadJWTFile())
+	require.Equal(t, rotated, currentJWT())
+}
+
+func TestExpiredJWTRefusesControllerRPCs(t *testing.T) {
+	tt := []struct {
+		name    string
+		method  string
+		expired bool
+		code    codes.Code
+	}{
+		{
+			name:   "controller RPC",
+			method: "/csi.v1.Controller/CreateVolume",
+			code:   codes.OK,
+		},
+		{
+			name:    "controller RPC with expired JWT",
+			method:  "/csi.v1.Controller/CreateVolume",
+			expired: true,
+			code:    codes.Unauthenticated,
+		},
+		{
+			name:    "identity RPC with expired JWT",
+			method:  "/csi.v1.Identity/Probe",
+			expired: true,
+			code:    codes.OK,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			if tc.expired {
+				f.jwt = newFakeJWT(time.Now().Add(-time.Minute))
+			}
+			d := newTestDriver(t, f)
+
+			called := false
+			_, err := d.intercept(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: tc.method},
+				func(ctx context.Context, req interface{}) (interface{}, error) {
+					called = true
+					return nil, nil
+				})
+			require.Equal(t, tc.code, status.Code(err), "unexpected error: %v", err)
+			require.Equal(t, tc.code == codes.OK, called)
+		})
+	}
+}
+
+// newSignedJWTs returns a function signing JWTs with the given expiry with a
+// key which is registered with the OVC SDK as the key of the identity
+// provider
+func newSignedJWTs(t *testing.T) func(expiry time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	require.NoError(t, ovc.SetJWTPublicKey(string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: publicKey,
+	}))))
+
+	return func(expiry time.Time) string {
+		jwt, err := jwtLib.NewWithClaims(jwtLib.SigningMethodES384, jwtLib.MapClaims{
+			"username": "csi",
+			"exp":      expiry.Unix(),
+		}).SignedString(key)
+		require.NoError(t, err)
+		return jwt
+	}
+}
+
+func TestClientCredentialsRenewal(t *testing.T) {
+	sign := newSignedJWTs(t)
+
+	// The API records the JWT of every call, every call is a task without
+	// a result
+	var mu sync.Mutex
+	var used []string
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/system/task/get") {
+			w.Write([]byte(`[true, []]`))
+			return
+		}
+		mu.Lock()
+		used = append(used, strings.TrimPrefix(r.Header.Get("Authorization"), "bearer "))
+		mu.Unlock()
+		w.Write([]byte(`"task"`))
+	}))
+	defer api.Close()
+	lastUsed := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return used[len(used)-1]
+	}
+
+	// Fetching a JWT with client credentials returns a new one every time
+	var fetched []string
+	newClient := func(config *ovc.Config) (*ovc.Client, error) {
+		require.Equal(t, "id", config.ClientID)
+		jwt := sign(time.Now().Add(time.Hour))
+		fetched = append(fetched, jwt)
+		return ovc.NewClient(&ovc.Config{URL: config.URL, JWT: jwt})
+	}
+	config := &ovc.Config{URL: api.URL, ClientID: "id", ClientSecret: "secret"}
+	c, err := newClient(config)
+	require.NoError(t, err)
+	client := newSDKClient(c)
+	jwt := &jwtServiceOp{client: client, config: *config, newClient: newClient}
+	client.renew = jwt.renew
+	locations := &locationServiceOp{client}
+
+	_, err = locations.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, fetched, 1)
+	require.Equal(t, fetched[0], lastUsed())
+
+	// The JWT expires, the SDK would refuse to use it
+	expiring, err := ovc.NewClient(&ovc.Config{URL: api.URL, JWT: sign(time.Now().Add(2 * time.Minute))})
+	require.NoError(t, err)
+	client.set(expiring)
+
+	_, err = locations.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, fetched, 2)
+	require.Equal(t, fetched[1], lastUsed())
+
+	// The renewed JWT is kept until it is about to expire
+	_, err = locations.List(context.Background())
+	require.NoError(t, err)
+	require.Len(t, fetched, 2)
+	current, err := jwt.Get(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, fetched[1], current)
+}
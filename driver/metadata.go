@@ -0,0 +1,113 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// diskMetadata describes the request a disk was created for. It is stored
+// as JSON in the description of the disk after the createdByGig marker, so
+// a retried CreateVolume can verify the disk matches the request.
+type diskMetadata struct {
+	// Cluster is the ID of the cluster the disk was created for
+	Cluster string `json:"cluster,omitempty"`
+	// PVName is the name of the PersistentVolume of the disk
+	PVName string `json:"pv,omitempty"`
+	// PVCName and PVCNamespace identify the PersistentVolumeClaim the disk
+	// was created for, if the external provisioner passes them
+	PVCName      string `json:"pvc,omitempty"`
+	PVCNamespace string `json:"namespace,omitempty"`
+	// ParametersHash is the hash of the parameters the disk was created with
+	ParametersHash string `json:"params,omitempty"`
+}
+
+// newDiskMetadata returns the metadata for a disk created for the given
+// request with the given parameters in the given cluster. The external
+// provisioner names volumes after their PersistentVolume, so the name of the
+// request is used if it doesn't pass the name of the PersistentVolume.
+func newDiskMetadata(req *csi.CreateVolumeRequest, params *volumeParameters, clusterID string) *diskMetadata {
+	pvName := req.Parameters[parameterPVName]
+	if pvName == "" {
+		pvName = req.Name
+	}
+	return &diskMetadata{
+		Cluster:        clusterID,
+		PVName:         pvName,
+		PVCName:        req.Parameters[parameterPVCName],
+		PVCNamespace:   req.Parameters[parameterPVCNamespace],
+		ParametersHash: parametersHash(params),
+	}
+}
+
+// parametersHash returns a short hash of the parameters of a volume
+func parametersHash(params *volumeParameters) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "type=%s,iops=%d,ssdSize=%d,fsType=%s",
+		params.diskType, params.iops, params.ssdSize, params.fsType)
+	return hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// description returns the description of a disk with the metadata
+func (m *diskMetadata) description() string {
+	data, err := json.Marshal(m)
+	if err != nil {
+		// Marshaling a struct of strings doesn't fail
+		return createdByGig
+	}
+	return createdByGig + " " + string(data)
+}
+
+// matches returns an error describing how the metadata of an existing disk
+// differs from the metadata of a request
+func (m *diskMetadata) matches(other *diskMetadata) error {
+	// Disks created before the cluster ID was configured match any cluster
+	if m.Cluster != "" && other.Cluster != "" && m.Cluster != other.Cluster {
+		return fmt.Errorf("it was created for cluster %s", m.Cluster)
+	}
+	if m.PVName != other.PVName {
+		return fmt.Errorf("it was created for PersistentVolume %s", m.PVName)
+	}
+	if m.ParametersHash != other.ParametersHash {
+		return fmt.Errorf("it was created with other parameters or another content source")
+	}
+	return nil
+}
+
+// parseDiskDescription returns whether a disk with the given description
+// was created by the driver and its metadata. The metadata is nil for disks
+// created before it was stored.
+func parseDiskDescription(description string) (owned bool, metadata *diskMetadata) {
+	if !strings.HasPrefix(description, createdByGig) {
+		return false, nil
+	}
+	data := strings.TrimSpace(strings.TrimPrefix(description, createdByGig))
+	if data == "" {
+		return true, nil
+	}
+	metadata = &diskMetadata{}
+	if err := json.Unmarshal([]byte(data), metadata); err != nil {
+		return false, nil
+	}
+	return true, metadata
+}
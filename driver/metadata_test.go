@@ -0,0 +1,68 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDiskDescription(t *testing.T) {
+	params, err := parseVolumeParameters(nil)
+	require.NoError(t, err)
+	metadata := newDiskMetadata(&csi.CreateVolumeRequest{
+		Name:       "pvc-1",
+		Parameters: map[string]string{parameterPVName: "pv-1"},
+	}, params, "cluster-1")
+
+	tt := []struct {
+		name        string
+		description string
+		owned       bool
+		metadata    *diskMetadata
+	}{
+		{name: "with metadata", description: metadata.description(), owned: true, metadata: metadata},
+		{name: "without metadata", description: createdByGig, owned: true},
+		{name: "other description", description: "my disk"},
+		{name: "empty description"},
+		{name: "invalid metadata", description: createdByGig + " {"},
+	}
+
+	for _, tc := range tt {
+		owned, got := parseDiskDescription(tc.description)
+		require.Equal(t, tc.owned, owned, tc.name)
+		require.Equal(t, tc.metadata, got, tc.name)
+	}
+	require.Equal(t, "pv-1", metadata.PVName)
+}
+
+func TestParametersHash(t *testing.T) {
+	defaults, err := parseVolumeParameters(nil)
+	require.NoError(t, err)
+	withIOPS, err := parseVolumeParameters(map[string]string{parameterIOPS: "1000"})
+	require.NoError(t, err)
+
+	require.Equal(t, parametersHash(defaults), parametersHash(defaults))
+	require.NotEqual(t, parametersHash(defaults), parametersHash(withIOPS))
+}
+
+func TestDiskMetadataMatches(t *testing.T) {
+	metadata := &diskMetadata{Cluster: "cluster-1", PVName: "pv-1", ParametersHash: "hash"}
+
+	tt := []struct {
+		name     string
+		existing diskMetadata
+		matches  bool
+	}{
+		{name: "same request", existing: *metadata, matches: true},
+		{name: "without cluster", existing: diskMetadata{PVName: "pv-1", ParametersHash: "hash"}, matches: true},
+		{name: "other cluster", existing: diskMetadata{Cluster: "cluster-2", PVName: "pv-1", ParametersHash: "hash"}},
+		{name: "other PersistentVolume", existing: diskMetadata{Cluster: "cluster-1", PVName: "pv-2", ParametersHash: "hash"}},
+		{name: "other parameters", existing: diskMetadata{Cluster: "cluster-1", PVName: "pv-1", ParametersHash: "other"}},
+	}
+
+	for _, tc := range tt {
+		err := tc.existing.matches(metadata)
+		require.Equal(t, tc.matches, err == nil, tc.name)
+	}
+}
@@ -0,0 +1,318 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/codes"
+)
+
+const metricsNamespace = "ovc_csi"
+
+// metrics holds the Prometheus metrics of the driver. They are kept in a
+// registry of their own, so several drivers can run in one process in tests.
+type metrics struct {
+	registry    *prometheus.Registry
+	rpcs        *prometheus.CounterVec
+	rpcDuration *prometheus.HistogramVec
+	apiDuration *prometheus.HistogramVec
+	apiErrors   *prometheus.CounterVec
+	jwtExpiry   prometheus.Gauge
+	// orphanedDisks and deletedDisks are only set by the garbage collector
+	orphanedDisks prometheus.Gauge
+	deletedDisks  prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		rpcs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "operations_total",
+			Help:      "Number of CSI operations by method and gRPC code.",
+		}, []string{"method", "code"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "operation_duration_seconds",
+			Help:      "Duration of CSI operations by method and gRPC code.",
+			Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120},
+		}, []string{"method", "code"}),
+		apiDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_call_duration_seconds",
+			Help:      "Duration of OVC API calls by operation.",
+			Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+		}, []string{"operation"}),
+		apiErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "api_call_errors_total",
+			Help:      "Number of failed OVC API calls by operation and gRPC code the error maps to.",
+		}, []string{"operation", "code"}),
+		jwtExpiry: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "jwt_expiry_timestamp_seconds",
+			Help:      "Unix time the JWT used for the OVC API expires at.",
+		}),
+		orphanedDisks: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "orphaned_disks",
+			Help:      "Number of disks created for the cluster that no PersistentVolume refers to.",
+		}),
+		deletedDisks: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "orphaned_disks_deleted_total",
+			Help:      "Number of orphaned disks deleted by the garbage collector.",
+		}),
+	}
+	m.registry.MustRegister(m.rpcs, m.rpcDuration, m.apiDuration, m.apiErrors, m.jwtExpiry, m.orphanedDisks, m.deletedDisks)
+	return m
+}
+
+// observeRPC records a CSI operation, method is the full gRPC method name
+func (m *metrics) observeRPC(method string, code codes.Code, duration time.Duration) {
+	method = path.Base(method)
+	m.rpcs.WithLabelValues(method, code.String()).Inc()
+	m.rpcDuration.WithLabelValues(method, code.String()).Observe(duration.Seconds())
+}
+
+// observeAPICall records an OVC API call which started at start and
+// returned *err, it is meant to be deferred
+func (m *metrics) observeAPICall(op string, start time.Time, err *error) {
+	m.apiDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if *err != nil {
+		m.apiErrors.WithLabelValues(op, errorCode(*err).String()).Inc()
+	}
+}
+
+// observeJWT records the expiry time of a JWT
+func (m *metrics) observeJWT(jwt string) {
+	if expiry, ok, err := jwtExpiry(jwt); err == nil && ok {
+		m.jwtExpiry.Set(float64(expiry.Unix()))
+	}
+}
+
+// observeAttachers exports the state of the attachers returned by attachers,
+// summed over the accounts
+func (m *metrics) observeAttachers(attachers func() []*attacher) {
+	m.registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "attach_queue_depth",
+			Help:      "Number of attach and detach requests queued or in progress.",
+		}, func() float64 {
+			var total int
+			for _, a := range attachers() {
+				queued, _ := a.stats()
+				total += queued
+			}
+			return float64(total)
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "attach_coalesced_total",
+			Help:      "Number of attach and detach requests that joined an identical pending request.",
+		}, func() float64 {
+			var total int
+			for _, a := range attachers() {
+				_, coalesced := a.stats()
+				total += coalesced
+			}
+			return float64(total)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "inventory_disks",
+			Help:      "Number of attached disks in the inventories of the attachers.",
+		}, func() float64 {
+			var total int
+			for _, a := range attachers() {
+				total += a.inventory.size()
+			}
+			return float64(total)
+		}),
+	)
+}
+
+// serveMetrics serves the metrics in the background
+func (d *Driver) serveMetrics() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(d.metrics.registry, promhttp.HandlerOpts{}))
+	d.metricsSrv = &http.Server{
+		Addr:    d.metricsAddress,
+		Handler: mux,
+	}
+	d.log.Infof("Serving metrics on address: %s", d.metricsAddress)
+	go func() {
+		if err := d.metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+			d.log.Errorf("Metrics server failed: %s", err)
+		}
+	}()
+}
+
+// instrumented returns a copy of the client recording the duration and
+// errors of every OVC API call, and the expiry of its JWT as the one of the
+// driver
+func (c *ovcClient) instrumented(m *metrics) *ovcClient {
+	return &ovcClient{
+		Disks:       &instrumentedDiskService{c.Disks, m},
+		Machines:    &instrumentedMachineService{c.Machines, m},
+		Accounts:    &instrumentedAccountService{c.Accounts, m},
+		CloudSpaces: &instrumentedCloudSpaceService{c.CloudSpaces, m},
+		Locations:   &instrumentedLocationService{c.Locations, m},
+		JWT:         &instrumentedJWTService{jwt: c.JWT, metrics: m, observeExpiry: true},
+	}
+}
+
+// instrumentedTenant is like instrumented for the client of a StorageClass
+// secret, of which the JWT expiry isn't recorded as it would hide the one of
+// the driver
+func (c *ovcClient) instrumentedTenant(m *metrics) *ovcClient {
+	client := c.instrumented(m)
+	client.JWT = &instrumentedJWTService{jwt: c.JWT, metrics: m}
+	return client
+}
+
+type instrumentedDiskService struct {
+	disks   diskService
+	metrics *metrics
+}
+
+func (s *instrumentedDiskService) List(ctx context.Context, accountID int, diskType string) (disks *[]ovc.Disk, err error) {
+	defer s.metrics.observeAPICall("Disks.List", time.Now(), &err)
+	return s.disks.List(ctx, accountID, diskType)
+}
+
+func (s *instrumentedDiskService) Get(ctx context.Context, diskID int) (disk *ovc.DiskInfo, err error) {
+	defer s.metrics.observeAPICall("Disks.Get", time.Now(), &err)
+	return s.disks.Get(ctx, diskID)
+}
+
+func (s *instrumentedDiskService) Create(ctx context.Context, diskConfig *ovc.DiskConfig) (diskID int, err error) {
+	defer s.metrics.observeAPICall("Disks.Create", time.Now(), &err)
+	return s.disks.Create(ctx, diskConfig)
+}
+
+func (s *instrumentedDiskService) Attach(ctx context.Context, attachConfig *ovc.DiskAttachConfig) (err error) {
+	defer s.metrics.observeAPICall("Disks.Attach", time.Now(), &err)
+	return s.disks.Attach(ctx, attachConfig)
+}
+
+func (s *instrumentedDiskService) Detach(ctx context.Context, attachConfig *ovc.DiskAttachConfig) (err error) {
+	defer s.metrics.observeAPICall("Disks.Detach", time.Now(), &err)
+	return s.disks.Detach(ctx, attachConfig)
+}
+
+func (s *instrumentedDiskService) Delete(ctx context.Context, deleteConfig *ovc.DiskDeleteConfig) (err error) {
+	defer s.metrics.observeAPICall("Disks.Delete", time.Now(), &err)
+	return s.disks.Delete(ctx, deleteConfig)
+}
+
+func (s *instrumentedDiskService) Resize(ctx context.Context, diskConfig *ovc.DiskConfig) (err error) {
+	defer s.metrics.observeAPICall("Disks.Resize", time.Now(), &err)
+	return s.disks.Resize(ctx, diskConfig)
+}
+
+type instrumentedMachineService struct {
+	machines machineService
+	metrics  *metrics
+}
+
+func (s *instrumentedMachineService) List(ctx context.Context, cloudspaceID int) (machines *[]ovc.Machine, err error) {
+	defer s.metrics.observeAPICall("Machines.List", time.Now(), &err)
+	return s.machines.List(ctx, cloudspaceID)
+}
+
+func (s *instrumentedMachineService) Get(ctx context.Context, machineID int) (machine *ovc.MachineInfo, err error) {
+	defer s.metrics.observeAPICall("Machines.Get", time.Now(), &err)
+	return s.machines.Get(ctx, machineID)
+}
+
+func (s *instrumentedMachineService) GetByReferenceID(ctx context.Context, referenceID string) (machine *ovc.MachineInfo, err error) {
+	defer s.metrics.observeAPICall("Machines.GetByReferenceID", time.Now(), &err)
+	return s.machines.GetByReferenceID(ctx, referenceID)
+}
+
+func (s *instrumentedMachineService) Stop(ctx context.Context, machineID int, force bool) (err error) {
+	defer s.metrics.observeAPICall("Machines.Stop", time.Now(), &err)
+	return s.machines.Stop(ctx, machineID, force)
+}
+
+type instrumentedAccountService struct {
+	accounts accountService
+	metrics  *metrics
+}
+
+func (s *instrumentedAccountService) GetIDByName(ctx context.Context, name string) (accountID int, err error) {
+	defer s.metrics.observeAPICall("Accounts.GetIDByName", time.Now(), &err)
+	return s.accounts.GetIDByName(ctx, name)
+}
+
+func (s *instrumentedAccountService) Get(ctx context.Context, accountID int) (account *AccountDetails, err error) {
+	defer s.metrics.observeAPICall("Accounts.Get", time.Now(), &err)
+	return s.accounts.Get(ctx, accountID)
+}
+
+type instrumentedCloudSpaceService struct {
+	cloudspaces cloudSpaceService
+	metrics     *metrics
+}
+
+func (s *instrumentedCloudSpaceService) List(ctx context.Context) (cloudspaces *[]ovc.CloudSpaceInfo, err error) {
+	defer s.metrics.observeAPICall("CloudSpaces.List", time.Now(), &err)
+	return s.cloudspaces.List(ctx)
+}
+
+func (s *instrumentedCloudSpaceService) Get(ctx context.Context, cloudspaceID int) (cloudspace *ovc.CloudSpace, err error) {
+	defer s.metrics.observeAPICall("CloudSpaces.Get", time.Now(), &err)
+	return s.cloudspaces.Get(ctx, cloudspaceID)
+}
+
+type instrumentedLocationService struct {
+	locations locationService
+	metrics   *metrics
+}
+
+func (s *instrumentedLocationService) List(ctx context.Context) (locations *ovc.LocationList, err error) {
+	defer s.metrics.observeAPICall("Locations.List", time.Now(), &err)
+	return s.locations.List(ctx)
+}
+
+type instrumentedJWTService struct {
+	jwt           jwtService
+	metrics       *metrics
+	observeExpiry bool
+}
+
+func (s *instrumentedJWTService) Get(ctx context.Context) (jwt string, err error) {
+	defer s.metrics.observeAPICall("JWT.Get", time.Now(), &err)
+	jwt, err = s.jwt.Get(ctx)
+	if jwt != "" && s.observeExpiry {
+		s.metrics.observeJWT(jwt)
+	}
+	return jwt, err
+}
+
+func (s *instrumentedJWTService) Set(jwt string) error {
+	return s.jwt.Set(jwt)
+}
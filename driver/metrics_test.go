@@ -0,0 +1,65 @@
+package driver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+)
+
+func TestMetricsAPICalls(t *testing.T) {
+	f := newFakeOVC()
+	diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+	m := newMetrics()
+	client := f.client().instrumented(m)
+
+	_, err := client.Disks.Get(context.Background(), diskID)
+	require.NoError(t, err)
+	f.failOn("Disks.Get", errGateway("503 Service Temporarily Unavailable"))
+	_, err = client.Disks.Get(context.Background(), diskID)
+	require.Error(t, err)
+	f.failOn("Disks.Get", nil)
+	_, err = client.Disks.Get(context.Background(), diskID+1)
+	require.Error(t, err)
+
+	require.Equal(t, 1.0, testutil.ToFloat64(m.apiErrors.WithLabelValues("Disks.Get", codes.Unavailable.String())))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.apiErrors.WithLabelValues("Disks.Get", codes.Internal.String())))
+}
+
+func TestMetricsJWTExpiry(t *testing.T) {
+	expiry := time.Now().Add(2 * time.Hour)
+	f := newFakeOVC()
+	f.jwt = newFakeJWT(expiry)
+	d := newTestDriver(t, f)
+
+	require.Equal(t, float64(expiry.Unix()), testutil.ToFloat64(d.metrics.jwtExpiry))
+
+	// The JWT of a StorageClass secret doesn't replace the one of the driver
+	tenantOVC := newFakeOVC()
+	tenantOVC.addAccount(tenantAccountName, -1)
+	tenantOVC.jwt = newFakeJWT(time.Now().Add(time.Hour))
+	d.tenants.newClient = func(config *ovc.Config) (*ovcClient, error) {
+		return tenantOVC.client(), nil
+	}
+	secrets := map[string]string{secretAccount: tenantAccountName, secretJWT: "jwt"}
+	for i := 0; i < 2; i++ {
+		_, err := d.tenant(context.Background(), secrets)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, tenantOVC.callCount("JWT.Get"))
+	require.Equal(t, float64(expiry.Unix()), testutil.ToFloat64(d.metrics.jwtExpiry))
+}
+
+func TestMetricsRPCs(t *testing.T) {
+	m := newMetrics()
+	m.observeRPC("/csi.v1.Controller/CreateVolume", codes.OK, time.Second)
+	m.observeRPC("/csi.v1.Controller/CreateVolume", codes.OK, time.Second)
+	m.observeRPC("/csi.v1.Controller/CreateVolume", codes.ResourceExhausted, time.Second)
+
+	require.Equal(t, 2.0, testutil.ToFloat64(m.rpcs.WithLabelValues("CreateVolume", codes.OK.String())))
+	require.Equal(t, 1.0, testutil.ToFloat64(m.rpcs.WithLabelValues("CreateVolume", codes.ResourceExhausted.String())))
+}
@@ -20,12 +20,17 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+	"k8s.io/kubernetes/pkg/util/resizefs"
 )
 
 const (
@@ -59,22 +64,20 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		return nil, status.Error(codes.InvalidArgument, "Volume capability not supported")
 	}
 
-	diskID, err := strconv.Atoi(volumeID)
-	if err != nil {
-		return nil, err
-	}
-	diskInfo, err := d.client.Disks.Get(diskID)
-	if err != nil {
-		return nil, err
-	}
-
-	source, err := getDevicePath(d.log, diskInfo.PCIBus, diskInfo.PCISlot)
+	source, err := d.publishedDevicePath(ctx, volumeID, req.GetPublishContext())
 	if err != nil {
 		return nil, err
 	}
 
 	d.log.Debugf("sourcepath for mounting: %v", source)
 
+	if volCap.GetBlock() != nil {
+		// Raw block volumes are published straight from the device, there
+		// is no filesystem to format and mount
+		d.log.Debugf("NodeStageVolume: volume %s is a block volume, nothing to stage", volumeID)
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
 	notMnt, err := d.mounter.Interface.IsNotMountPoint(target)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -94,11 +97,7 @@ func (d *Driver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRe
 		return nil, status.Error(codes.InvalidArgument, msg)
 	}
 	// Get fs type that the volume will be formatted with
-	attributes := req.GetVolumeContext()
-	fsType, exists := attributes["fsType"]
-	if !exists || fsType == "" {
-		fsType = defaultFsType
-	}
+	fsType := volumeFsType(volCap, req.GetVolumeContext())
 
 	// FormatAndMount will format only if needed
 	d.log.Debugf("NodeStageVolume: formatting %s and mounting at %s", source, target)
@@ -125,8 +124,18 @@ func (d *Driver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolu
 		return nil, status.Error(codes.InvalidArgument, "Staging target not provided")
 	}
 
+	notMnt, err := d.mounter.Interface.IsLikelyNotMountPoint(target)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, status.Errorf(codes.Internal, "Could not determine if %q is a mount point: %v", target, err)
+	}
+	if notMnt || os.IsNotExist(err) {
+		// Block volumes are never mounted at the staging path
+		d.log.Debugf("NodeUnstageVolume: %s is not mounted, nothing to unstage", target)
+		return &csi.NodeUnstageVolumeResponse{}, nil
+	}
+
 	d.log.Debugf("NodeUnstageVolume: unmounting %s", target)
-	err := d.mounter.Interface.Unmount(target)
+	err = d.mounter.Interface.Unmount(target)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not unmount target %q: %v", target, err)
 	}
@@ -166,16 +175,16 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 		options = append(options, "ro")
 	}
 
+	if volCap.GetBlock() != nil {
+		return d.nodePublishBlockVolume(ctx, volumeID, req.GetPublishContext(), target, options)
+	}
+
 	d.log.Debugf("NodePublishVolume: creating dir %s", target)
 	if err := d.mounter.Interface.MakeDir(target); err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not create dir %q: %v", target, err)
 	}
 
-	attributes := req.GetVolumeContext()
-	fsType, exists := attributes["fsType"]
-	if !exists || fsType == "" {
-		fsType = defaultFsType
-	}
+	fsType := volumeFsType(volCap, req.GetVolumeContext())
 
 	d.log.Debugf("NodePublishVolume: mounting %s at %s", source, target)
 	if err := d.mounter.Interface.Mount(source, target, fsType, options); err != nil {
@@ -186,6 +195,34 @@ func (d *Driver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolu
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// nodePublishBlockVolume bind mounts the device of a raw block volume onto a
+// file at the target path
+func (d *Driver) nodePublishBlockVolume(ctx context.Context, volumeID string, publishContext map[string]string, target string, options []string) (*csi.NodePublishVolumeResponse, error) {
+	source, err := d.publishedDevicePath(ctx, volumeID, publishContext)
+	if err != nil {
+		return nil, err
+	}
+
+	targetDir := filepath.Dir(target)
+	d.log.Debugf("NodePublishVolume: creating dir %s", targetDir)
+	if err := d.mounter.Interface.MakeDir(targetDir); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not create dir %q: %v", targetDir, err)
+	}
+
+	d.log.Debugf("NodePublishVolume: creating file %s", target)
+	if err := d.mounter.Interface.MakeFile(target); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not create file %q: %v", target, err)
+	}
+
+	d.log.Debugf("NodePublishVolume: mounting device %s at %s", source, target)
+	if err := d.mounter.Interface.Mount(source, target, "", options); err != nil {
+		os.Remove(target)
+		return nil, status.Errorf(codes.Internal, "Could not mount %q at %q: %v", source, target, err)
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
 // NodeUnpublishVolume unmounts the volume from the target path
 func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	d.log.Debugf("NodeUnpublishVolume: called with args %#v", req)
@@ -205,6 +242,14 @@ func (d *Driver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublish
 		return nil, status.Errorf(codes.Internal, "Could not unmount %q: %v", target, err)
 	}
 
+	// Block volumes are published on a file which the CO does not clean up
+	if info, err := os.Stat(target); err == nil && !info.IsDir() {
+		d.log.Debugf("NodeUnpublishVolume: removing file %s", target)
+		if err := os.Remove(target); err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not remove %q: %v", target, err)
+		}
+	}
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
@@ -230,28 +275,227 @@ func (d *Driver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabi
 func (d *Driver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
 	d.log.Debugf("NodeGetInfo: called with args %#v", req)
 
+	var topology *csi.Topology
+	if location := d.locationByGridID(d.nodeGridID); location != nil {
+		topology = locationTopology(*location)
+	}
+
 	return &csi.NodeGetInfoResponse{
-		NodeId: d.nodeID,
+		NodeId:             d.nodeID,
+		AccessibleTopology: topology,
 	}, nil
 }
 
-// NodeGetVolumeStats get the volumestats of a node
-// Currently not implemented
+// NodeGetVolumeStats returns the capacity and inode usage of a published
+// volume, or the size of the device for block volumes
 func (d *Driver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	d.log.WithFields(logrus.Fields{
-		"volume_id": req.VolumeId,
-		"method":    "resize_volume",
-	}).Warn("NodeGetVolumeStats is not implemented")
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path not provided")
+	}
+
+	ll := d.log.WithFields(logrus.Fields{
+		"volume_id":   volumeID,
+		"volume_path": volumePath,
+		"method":      "node_get_volume_stats",
+	})
+	ll.Debug("Node get volume stats called")
+
+	info, err := os.Stat(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "Volume path %q does not exist", volumePath)
+		}
+		return nil, status.Errorf(codes.Internal, "Could not stat volume path %q: %v", volumePath, err)
+	}
+
+	notMnt, err := d.mounter.Interface.IsLikelyNotMountPoint(volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not determine if %q is a mount point: %v", volumePath, err)
+	}
+	if notMnt {
+		return nil, status.Errorf(codes.NotFound, "Volume path %q is not mounted", volumePath)
+	}
+
+	if info.Mode()&os.ModeDevice != 0 {
+		size, err := d.blockDeviceSize(volumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not get size of block device %q: %v", volumePath, err)
+		}
+		return &csi.NodeGetVolumeStatsResponse{
+			Usage: []*csi.VolumeUsage{
+				{
+					Unit:  csi.VolumeUsage_BYTES,
+					Total: size,
+				},
+			},
+		}, nil
+	}
+
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(volumePath, &statfs); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not statfs %q: %v", volumePath, err)
+	}
 
-	return nil, status.Error(codes.Unimplemented, "")
+	blockSize := int64(statfs.Bsize)
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: []*csi.VolumeUsage{
+			{
+				Unit:      csi.VolumeUsage_BYTES,
+				Total:     int64(statfs.Blocks) * blockSize,
+				Used:      int64(statfs.Blocks-statfs.Bfree) * blockSize,
+				Available: int64(statfs.Bavail) * blockSize,
+			},
+			{
+				Unit:      csi.VolumeUsage_INODES,
+				Total:     int64(statfs.Files),
+				Used:      int64(statfs.Files - statfs.Ffree),
+				Available: int64(statfs.Ffree),
+			},
+		},
+	}, nil
+}
+
+// blockDeviceSize returns the size in bytes of the given block device
+func (d *Driver) blockDeviceSize(devicePath string) (int64, error) {
+	output, err := d.mounter.Exec.Run("blockdev", "--getsize64", devicePath)
+	if err != nil {
+		return 0, fmt.Errorf("%v: %s", err, string(output))
+	}
+
+	return strconv.ParseInt(strings.TrimSpace(string(output)), 10, 64)
 }
 
-// NodeExpandVolume expands the volume.
+// NodeExpandVolume grows the filesystem of a mounted volume after the disk
+// itself has been expanded by ControllerExpandVolume
 func (d *Driver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	d.log.WithFields(logrus.Fields{
-		"volume_id": req.VolumeId,
-		"method":    "resize_volume",
-	}).Warn("NodeExpandVolume is not implemented")
+	volumeID := req.GetVolumeId()
+	if len(volumeID) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
+	}
+
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "Volume path not provided")
+	}
+
+	ll := d.log.WithFields(logrus.Fields{
+		"volume_id":   volumeID,
+		"volume_path": volumePath,
+		"method":      "node_expand_volume",
+	})
+	ll.Debug("Node expand volume called")
+
+	info, err := os.Stat(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "Volume path %q does not exist", volumePath)
+		}
+		return nil, status.Errorf(codes.Internal, "Could not stat volume path %q: %v", volumePath, err)
+	}
+
+	// Raw block volumes have no filesystem to grow
+	if info.Mode()&os.ModeDevice != 0 {
+		size, err := d.blockDeviceSize(volumePath)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not get size of block device %q: %v", volumePath, err)
+		}
+		return &csi.NodeExpandVolumeResponse{CapacityBytes: size}, nil
+	}
+
+	// The device is taken from the mount rather than from the OVC API, as the
+	// disk may be in an account the node has no credentials for
+	devicePath, _, err := mount.GetDeviceNameFromMount(d.mounter.Interface, volumePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not determine the device mounted at %q: %v", volumePath, err)
+	}
+	if devicePath == "" {
+		return nil, status.Errorf(codes.NotFound, "Volume path %q is not mounted", volumePath)
+	}
+
+	if err := rescanDevice(d.log, d.hostRoot, devicePath); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not rescan device %q: %v", devicePath, err)
+	}
+
+	ll.Debugf("NodeExpandVolume: resizing filesystem of %s mounted at %s", devicePath, volumePath)
+	resizer := resizefs.NewResizeFs(d.mounter)
+	if _, err := resizer.Resize(devicePath, volumePath); err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not resize filesystem of %q: %v", devicePath, err)
+	}
+
+	size, err := d.blockDeviceSize(devicePath)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Could not get size of block device %q: %v", devicePath, err)
+	}
+
+	return &csi.NodeExpandVolumeResponse{
+		CapacityBytes: size,
+	}, nil
+}
+
+// volumeFsType returns the filesystem type of a volume. The filesystem type of
+// the volume capability takes precedence over the one of the StorageClass.
+func volumeFsType(volCap *csi.VolumeCapability, volumeContext map[string]string) string {
+	if fsType := volCap.GetMount().GetFsType(); fsType != "" {
+		return fsType
+	}
+	if fsType := volumeContext[parameterFsType]; fsType != "" {
+		return fsType
+	}
+	return defaultFsType
+}
+
+// publishedDevicePath returns the path of the device the given volume is
+// attached as on this node, from the PCI address the controller passed in the
+// publish context. Volumes published by a controller that didn't pass it yet
+// are looked up with the OVC API, which only finds the disks of the account
+// of the driver.
+func (d *Driver) publishedDevicePath(ctx context.Context, volumeID string, publishContext map[string]string) (string, error) {
+	bus, hasBus := publishContext[publishInfoPCIBus]
+	slot, hasSlot := publishContext[publishInfoPCISlot]
+	if !hasBus || !hasSlot {
+		return d.volumeDevicePath(ctx, volumeID)
+	}
+
+	pciBus, err := strconv.Atoi(bus)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "Invalid PCI bus %q in publish context", bus)
+	}
+	pciSlot, err := strconv.Atoi(slot)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "Invalid PCI slot %q in publish context", slot)
+	}
+
+	return d.pciDevicePath(volumeID, pciBus, pciSlot)
+}
+
+// volumeDevicePath returns the path of the device the given volume is attached
+// as on this node
+func (d *Driver) volumeDevicePath(ctx context.Context, volumeID string) (string, error) {
+	diskID, err := strconv.Atoi(volumeID)
+	if err != nil {
+		return "", status.Error(codes.NotFound, "Volume not found")
+	}
+	diskInfo, err := d.defaultTenant().getVolume(ctx, diskID)
+	if err != nil {
+		return "", err
+	}
+
+	return d.pciDevicePath(volumeID, diskInfo.PCIBus, diskInfo.PCISlot)
+}
+
+// pciDevicePath returns the path of the device attached on the given PCI
+// address of this node
+func (d *Driver) pciDevicePath(volumeID string, pciBus, pciSlot int) (string, error) {
+	devicePath, err := getDevicePath(d.log, d.hostRoot, pciBus, pciSlot)
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "Could not find device of volume %s: %v", volumeID, err)
+	}
 
-	return nil, status.Error(codes.Unimplemented, "")
+	return devicePath, nil
 }
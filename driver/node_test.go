@@ -0,0 +1,565 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// testNode is a node driver running on a machine of the fake, with its host
+// filesystem in a temporary directory
+type testNode struct {
+	*Driver
+	fake      *fakeOVC
+	machineID int
+	hostRoot  string
+	mounter   *mount.FakeMounter
+	commands  [][]string
+	// outputs holds the output of the commands run on the node by name
+	outputs map[string]string
+}
+
+func newTestNode(t *testing.T, f *fakeOVC) *testNode {
+	hostRoot, err := ioutil.TempDir("", "ovc-csi-node")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(hostRoot) })
+
+	cloudspaceID := f.addCloudSpace(f.accountID(), -1)
+	machineID := f.addMachine(cloudspaceID)
+
+	// The product UUID is uppercase in DMI, while the reference ID isn't
+	uuidFile := filepath.Join(hostRoot, uuidPath)
+	require.NoError(t, os.MkdirAll(filepath.Dir(uuidFile), 0755))
+	require.NoError(t, ioutil.WriteFile(uuidFile, []byte(strings.ToUpper(f.machineReferenceID(machineID))+"\n"), 0644))
+	require.NoError(t, os.MkdirAll(filepath.Join(hostRoot, disksByPathDir), 0755))
+
+	node := &testNode{
+		fake:      f,
+		machineID: machineID,
+		hostRoot:  hostRoot,
+		mounter:   &mount.FakeMounter{},
+		outputs:   map[string]string{},
+	}
+	exec := mount.NewFakeExec(func(cmd string, args ...string) ([]byte, error) {
+		node.commands = append(node.commands, append([]string{cmd}, args...))
+		return []byte(node.outputs[cmd]), nil
+	})
+
+	node.Driver, err = newDriver(&Config{
+		Account:  fakeAccountName,
+		Mode:     NodeMode,
+		HostRoot: hostRoot,
+		Mounter:  &mount.SafeFormatAndMount{Interface: node.mounter, Exec: exec},
+	}, f.client())
+	require.NoError(t, err)
+	t.Cleanup(node.Stop)
+
+	return node
+}
+
+// addDevice creates the device of a disk attached on the given PCI slot,
+// together with its link in /dev/disk/by-path, and returns the device path
+func (n *testNode) addDevice(t *testing.T, name string, slot int) string {
+	device := filepath.Join(n.hostRoot, "dev", name)
+	require.NoError(t, ioutil.WriteFile(device, nil, 0644))
+	n.addDeviceLink(t, fmt.Sprintf("virtio-pci-0000:00:%02x.0", slot), name)
+	return device
+}
+
+// addDeviceLink creates a link in /dev/disk/by-path to a device
+func (n *testNode) addDeviceLink(t *testing.T, link, name string) {
+	require.NoError(t, os.Symlink(filepath.Join("..", "..", name), filepath.Join(n.hostRoot, disksByPathDir, link)))
+}
+
+// attachedVolume adds a disk attached to the node and returns its volume ID
+// and PCI slot
+func (n *testNode) attachedVolume() (string, int) {
+	diskID := n.fake.addDisk(n.fake.accountID(), "pvc-1", 10)
+	slot := n.fake.attachDisk(diskID, n.machineID)
+	return strconv.Itoa(diskID), slot
+}
+
+func TestNodeGetInfo(t *testing.T) {
+	node := newTestNode(t, newFakeOVC())
+
+	resp, err := node.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	require.NoError(t, err)
+	require.Equal(t, strconv.Itoa(node.machineID), resp.NodeId)
+	require.Equal(t, fakeLocation, resp.AccessibleTopology.Segments[topologyKeyLocation])
+}
+
+func TestGetDevicePath(t *testing.T) {
+	tt := []struct {
+		name  string
+		links map[string]string
+		slot  int
+		pass  bool
+	}{
+		{
+			name: "disk",
+			links: map[string]string{
+				"virtio-pci-0000:00:0a.0": "vdb",
+				"virtio-pci-0000:00:0b.0": "vdc",
+			},
+			slot: 11,
+			pass: true,
+		},
+		{
+			name: "partitions are skipped",
+			links: map[string]string{
+				"virtio-pci-0000:00:0a.0-part1": "vdb1",
+			},
+			slot: 10,
+			pass: false,
+		},
+		{
+			name: "missing device",
+			links: map[string]string{
+				"virtio-pci-0000:00:0a.0": "vdb",
+			},
+			slot: 12,
+			pass: false,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			node := newTestNode(t, newFakeOVC())
+			for link, name := range tc.links {
+				require.NoError(t, ioutil.WriteFile(filepath.Join(node.hostRoot, "dev", name), nil, 0644))
+				node.addDeviceLink(t, link, name)
+			}
+
+			device, err := getDevicePath(node.log, node.hostRoot, 0, tc.slot)
+			if !tc.pass {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, filepath.Join(node.hostRoot, "dev", tc.links[fmt.Sprintf("virtio-pci-0000:00:%02x.0", tc.slot)]), device)
+		})
+	}
+}
+
+func TestNodeStageVolume(t *testing.T) {
+	tt := []struct {
+		name      string
+		device    bool
+		published bool
+		volCap    *csi.VolumeCapability
+		context   map[string]string
+		code      codes.Code
+		mounted   bool
+		mountFs   string
+		volumeID  func(volumeID string) string
+	}{
+		{
+			name:    "mount volume",
+			device:  true,
+			volCap:  mountCapability(),
+			code:    codes.OK,
+			mounted: true,
+			mountFs: defaultFsType,
+		},
+		{
+			name:    "fsType from StorageClass",
+			device:  true,
+			volCap:  mountCapability(),
+			context: map[string]string{parameterFsType: "xfs"},
+			code:    codes.OK,
+			mounted: true,
+			mountFs: "xfs",
+		},
+		{
+			name:    "block volume",
+			device:  true,
+			volCap:  blockCapability(),
+			code:    codes.OK,
+			mounted: false,
+		},
+		{
+			name:   "missing device",
+			device: false,
+			volCap: mountCapability(),
+			code:   codes.Internal,
+		},
+		{
+			name:     "missing volume",
+			device:   true,
+			volCap:   mountCapability(),
+			code:     codes.NotFound,
+			volumeID: func(string) string { return "1000" },
+		},
+		{
+			// The disk is in an account the node has no credentials for
+			name:      "device from publish context",
+			device:    true,
+			published: true,
+			volCap:    mountCapability(),
+			code:      codes.OK,
+			mounted:   true,
+			mountFs:   defaultFsType,
+			volumeID:  func(string) string { return "1000" },
+		},
+		{
+			name:   "missing capability",
+			device: true,
+			code:   codes.InvalidArgument,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			node := newTestNode(t, newFakeOVC())
+			volumeID, slot := node.attachedVolume()
+			var device string
+			if tc.device {
+				device = node.addDevice(t, "vdb", slot)
+			}
+			if tc.volumeID != nil {
+				volumeID = tc.volumeID(volumeID)
+			}
+			var publishContext map[string]string
+			if tc.published {
+				publishContext = map[string]string{
+					publishInfoPCIBus:  "0",
+					publishInfoPCISlot: strconv.Itoa(slot),
+				}
+			}
+			staging := filepath.Join(node.hostRoot, "staging")
+			require.NoError(t, os.Mkdir(staging, 0755))
+
+			_, err := node.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+				VolumeId:          volumeID,
+				PublishContext:    publishContext,
+				StagingTargetPath: staging,
+				VolumeCapability:  tc.volCap,
+				VolumeContext:     tc.context,
+			})
+			require.Equal(t, tc.code, status.Code(err), "unexpected error: %v", err)
+			if tc.published {
+				require.Zero(t, node.fake.callCount("Disks.Get"))
+			}
+
+			if !tc.mounted {
+				require.Empty(t, node.mounter.MountPoints)
+				return
+			}
+			require.Len(t, node.mounter.MountPoints, 1)
+			require.Equal(t, device, node.mounter.MountPoints[0].Device)
+			require.Equal(t, staging, node.mounter.MountPoints[0].Path)
+			require.Equal(t, tc.mountFs, node.mounter.MountPoints[0].Type)
+			require.Equal(t, [][]string{{"fsck", "-a", device}}, node.commands)
+		})
+	}
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	tt := []struct {
+		name    string
+		block   bool
+		rescan  bool
+		mounted bool
+		missing bool
+		code    codes.Code
+	}{
+		{
+			name:    "expand volume",
+			mounted: true,
+			code:    codes.OK,
+		},
+		{
+			name:    "device with rescan trigger",
+			rescan:  true,
+			mounted: true,
+			code:    codes.OK,
+		},
+		{
+			name:  "block volume",
+			block: true,
+			code:  codes.OK,
+		},
+		{
+			name: "volume not mounted",
+			code: codes.NotFound,
+		},
+		{
+			name:    "missing volume path",
+			missing: true,
+			code:    codes.NotFound,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			node := newTestNode(t, newFakeOVC())
+			volumeID, slot := node.attachedVolume()
+			device := node.addDevice(t, "vdb", slot)
+			rescan := filepath.Join(node.hostRoot, sysClassBlockDir, "vdb", "device", "rescan")
+			if tc.rescan {
+				require.NoError(t, os.MkdirAll(filepath.Dir(rescan), 0755))
+				require.NoError(t, ioutil.WriteFile(rescan, nil, 0200))
+			}
+			volumePath := filepath.Join(node.hostRoot, "volume")
+			switch {
+			case tc.block:
+				// Device nodes can't be created without privileges, so the
+				// published block volume links to the null device instead
+				require.NoError(t, os.Symlink(os.DevNull, volumePath))
+			case !tc.missing:
+				require.NoError(t, os.Mkdir(volumePath, 0755))
+			}
+			if tc.mounted {
+				node.mounter.MountPoints = append(node.mounter.MountPoints, mount.MountPoint{Device: device, Path: volumePath})
+			}
+			node.outputs["blkid"] = "DEVNAME=" + device + "\nTYPE=ext4\n"
+			node.outputs["blockdev"] = strconv.Itoa(20*GiB) + "\n"
+
+			resp, err := node.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+				VolumeId:   volumeID,
+				VolumePath: volumePath,
+			})
+			require.Equal(t, tc.code, status.Code(err), "unexpected error: %v", err)
+			if tc.code != codes.OK {
+				require.Empty(t, node.commands)
+				return
+			}
+
+			// The disk may be in an account the node has no credentials for
+			require.Zero(t, node.fake.callCount("Disks.Get"))
+			require.Equal(t, int64(20*GiB), resp.CapacityBytes)
+			if tc.block {
+				require.Equal(t, [][]string{{"blockdev", "--getsize64", volumePath}}, node.commands)
+				return
+			}
+			require.Contains(t, node.commands, []string{"resize2fs", device})
+			require.Contains(t, node.commands, []string{"blockdev", "--getsize64", device})
+			if tc.rescan {
+				content, err := ioutil.ReadFile(rescan)
+				require.NoError(t, err)
+				require.Equal(t, "1", string(content))
+			}
+		})
+	}
+}
+
+func TestNodePublishUnpublishVolume(t *testing.T) {
+	tt := []struct {
+		name     string
+		volCap   *csi.VolumeCapability
+		readonly bool
+		// block volumes are bind mounted from the device instead of from
+		// the staging path
+		block bool
+	}{
+		{
+			name:   "mount volume",
+			volCap: mountCapability(),
+		},
+		{
+			name:     "read only mount volume",
+			volCap:   mountCapability(),
+			readonly: true,
+		},
+		{
+			name:   "block volume",
+			volCap: blockCapability(),
+			block:  true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			node := newTestNode(t, newFakeOVC())
+			volumeID, slot := node.attachedVolume()
+			device := node.addDevice(t, "vdb", slot)
+			staging := filepath.Join(node.hostRoot, "staging")
+			target := filepath.Join(node.hostRoot, "target")
+			require.NoError(t, os.Mkdir(staging, 0755))
+
+			_, err := node.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          volumeID,
+				StagingTargetPath: staging,
+				TargetPath:        target,
+				VolumeCapability:  tc.volCap,
+				Readonly:          tc.readonly,
+			})
+			require.NoError(t, err)
+
+			require.Len(t, node.mounter.MountPoints, 1)
+			mountPoint := node.mounter.MountPoints[0]
+			require.Equal(t, target, mountPoint.Path)
+			require.Contains(t, mountPoint.Opts, "bind")
+			if tc.readonly {
+				require.Contains(t, mountPoint.Opts, "ro")
+			}
+			if tc.block {
+				require.Equal(t, device, mountPoint.Device)
+				// The fake mounter doesn't create the file to bind
+				// mount on, which the real one does
+				require.NoError(t, ioutil.WriteFile(target, nil, 0644))
+			} else {
+				require.Equal(t, staging, mountPoint.Device)
+			}
+
+			_, err = node.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   volumeID,
+				TargetPath: target,
+			})
+			require.NoError(t, err)
+			require.Empty(t, node.mounter.MountPoints)
+			if tc.block {
+				_, err := os.Stat(target)
+				require.True(t, os.IsNotExist(err), "block target file was not removed")
+			}
+		})
+	}
+}
+
+func TestNodeUnstageVolume(t *testing.T) {
+	tt := []struct {
+		name    string
+		staged  bool
+		missing bool
+	}{
+		{
+			name:   "staged volume",
+			staged: true,
+		},
+		{
+			name: "volume not staged",
+		},
+		{
+			name:    "missing staging path",
+			missing: true,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			node := newTestNode(t, newFakeOVC())
+			volumeID, slot := node.attachedVolume()
+			node.addDevice(t, "vdb", slot)
+			staging := filepath.Join(node.hostRoot, "staging")
+			if !tc.missing {
+				require.NoError(t, os.Mkdir(staging, 0755))
+			}
+			if tc.staged {
+				_, err := node.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+					VolumeId:          volumeID,
+					StagingTargetPath: staging,
+					VolumeCapability:  mountCapability(),
+				})
+				require.NoError(t, err)
+				require.Len(t, node.mounter.MountPoints, 1)
+			}
+
+			_, err := node.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+				VolumeId:          volumeID,
+				StagingTargetPath: staging,
+			})
+			require.NoError(t, err)
+			require.Empty(t, node.mounter.MountPoints)
+		})
+	}
+}
+
+func TestNodeGetVolumeStats(t *testing.T) {
+	tt := []struct {
+		name    string
+		block   bool
+		mounted bool
+		missing bool
+		code    codes.Code
+	}{
+		{
+			name:    "filesystem volume",
+			mounted: true,
+			code:    codes.OK,
+		},
+		{
+			name:    "block volume",
+			block:   true,
+			mounted: true,
+			code:    codes.OK,
+		},
+		{
+			name: "volume not mounted",
+			code: codes.NotFound,
+		},
+		{
+			name:    "missing volume path",
+			missing: true,
+			code:    codes.NotFound,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			node := newTestNode(t, newFakeOVC())
+			volumeID, slot := node.attachedVolume()
+			device := node.addDevice(t, "vdb", slot)
+			volumePath := filepath.Join(node.hostRoot, "volume")
+			switch {
+			case tc.block:
+				// Device nodes can't be created without privileges, so the
+				// published block volume links to the null device instead
+				require.NoError(t, os.Symlink(os.DevNull, volumePath))
+				node.outputs["blockdev"] = strconv.Itoa(10*GiB) + "\n"
+			case !tc.missing:
+				require.NoError(t, os.Mkdir(volumePath, 0755))
+			}
+			if tc.mounted {
+				mountPath, err := filepath.EvalSymlinks(volumePath)
+				require.NoError(t, err)
+				node.mounter.MountPoints = append(node.mounter.MountPoints, mount.MountPoint{Device: device, Path: mountPath})
+			}
+
+			resp, err := node.NodeGetVolumeStats(context.Background(), &csi.NodeGetVolumeStatsRequest{
+				VolumeId:   volumeID,
+				VolumePath: volumePath,
+			})
+			require.Equal(t, tc.code, status.Code(err), "unexpected error: %v", err)
+			if tc.code != codes.OK {
+				return
+			}
+
+			if tc.block {
+				require.Equal(t, [][]string{{"blockdev", "--getsize64", volumePath}}, node.commands)
+				require.Equal(t, []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Total: 10 * GiB}}, resp.Usage)
+				return
+			}
+
+			require.Empty(t, node.commands)
+			require.Len(t, resp.Usage, 2)
+			for _, usage := range resp.Usage {
+				require.NotZero(t, usage.Total)
+				require.True(t, usage.Used+usage.Available <= usage.Total, "usage %v exceeds the total", usage)
+			}
+			require.Equal(t, csi.VolumeUsage_BYTES, resp.Usage[0].Unit)
+			require.Equal(t, csi.VolumeUsage_INODES, resp.Usage[1].Unit)
+		})
+	}
+}
+
+func blockCapability() *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{
+			Block: &csi.VolumeCapability_BlockVolume{},
+		},
+		AccessMode: &csi.VolumeCapability_AccessMode{
+			Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		},
+	}
+}
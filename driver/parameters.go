@@ -0,0 +1,127 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// parameterType is the StorageClass parameter for the G8 disk type
+	parameterType = "type"
+	// parameterIOPS is the StorageClass parameter for the IOPS limit of the disk
+	parameterIOPS = "iops"
+	// parameterSSDSize is the StorageClass parameter for the SSD cache size of
+	// the disk in GiB
+	parameterSSDSize = "ssdSize"
+	// parameterFsType is the StorageClass parameter for the filesystem the
+	// volume is formatted with
+	parameterFsType = "fsType"
+
+	// reservedParameterPrefix is the prefix of parameters that are added by
+	// the CO and its sidecars rather than by the user
+	reservedParameterPrefix = "csi.storage.k8s.io/"
+	// parameterPVName is the parameter the external provisioner passes the
+	// name of the PersistentVolume in when it runs with
+	// --extra-create-metadata
+	parameterPVName = reservedParameterPrefix + "pv/name"
+	// parameterPVCName and parameterPVCNamespace are the parameters the
+	// external provisioner passes the PersistentVolumeClaim of the volume in
+	parameterPVCName      = reservedParameterPrefix + "pvc/name"
+	parameterPVCNamespace = reservedParameterPrefix + "pvc/namespace"
+
+	// bootDiskType and cdromDiskType are G8 disk types that can't be used
+	// as a volume
+	bootDiskType  = "B"
+	cdromDiskType = "C"
+)
+
+// supportedFsTypes lists the filesystems a volume can be formatted with
+var supportedFsTypes = []string{"ext3", "ext4", "xfs"}
+
+// volumeParameters holds the validated StorageClass parameters of a volume
+type volumeParameters struct {
+	diskType string
+	iops     int
+	ssdSize  int
+	fsType   string
+}
+
+// parseVolumeParameters validates the given StorageClass parameters and
+// returns them as volume parameters. Unknown parameters result in an error.
+func parseVolumeParameters(params map[string]string) (*volumeParameters, error) {
+	vp := &volumeParameters{
+		diskType: defaultDiskType,
+	}
+
+	for key, value := range params {
+		switch key {
+		case parameterType:
+			diskType := strings.ToUpper(value)
+			if diskType == "" || diskType == bootDiskType || diskType == cdromDiskType {
+				return nil, fmt.Errorf("invalid %s parameter %q", parameterType, value)
+			}
+			vp.diskType = diskType
+		case parameterIOPS:
+			iops, err := parsePositiveInt(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s parameter %q: %s", parameterIOPS, value, err)
+			}
+			vp.iops = iops
+		case parameterSSDSize:
+			ssdSize, err := parsePositiveInt(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s parameter %q: %s", parameterSSDSize, value, err)
+			}
+			vp.ssdSize = ssdSize
+		case parameterFsType:
+			if !isSupportedFsType(value) {
+				return nil, fmt.Errorf("invalid %s parameter %q, supported are %s", parameterFsType, value, strings.Join(supportedFsTypes, ", "))
+			}
+			vp.fsType = value
+		default:
+			if strings.HasPrefix(key, reservedParameterPrefix) {
+				continue
+			}
+			return nil, fmt.Errorf("unknown parameter %q", key)
+		}
+	}
+
+	return vp, nil
+}
+
+func parsePositiveInt(value string) (int, error) {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, err
+	}
+	if i <= 0 {
+		return 0, fmt.Errorf("must be larger than 0")
+	}
+	return i, nil
+}
+
+func isSupportedFsType(fsType string) bool {
+	for _, t := range supportedFsTypes {
+		if t == fsType {
+			return true
+		}
+	}
+	return false
+}
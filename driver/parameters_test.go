@@ -0,0 +1,69 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseVolumeParameters(t *testing.T) {
+	tt := []struct {
+		params   map[string]string
+		expected *volumeParameters
+		pass     bool
+	}{
+		{
+			params:   nil,
+			expected: &volumeParameters{diskType: defaultDiskType},
+			pass:     true,
+		},
+		{
+			params: map[string]string{
+				"type":    "d",
+				"iops":    "2000",
+				"ssdSize": "10",
+				"fsType":  "xfs",
+			},
+			expected: &volumeParameters{diskType: "D", iops: 2000, ssdSize: 10, fsType: "xfs"},
+			pass:     true,
+		},
+		{
+			params: map[string]string{
+				"csi.storage.k8s.io/fstype": "ext4",
+			},
+			expected: &volumeParameters{diskType: defaultDiskType},
+			pass:     true,
+		},
+		{
+			params: map[string]string{"type": "B"},
+			pass:   false,
+		},
+		{
+			params: map[string]string{"iops": "-1"},
+			pass:   false,
+		},
+		{
+			params: map[string]string{"ssdSize": "ten"},
+			pass:   false,
+		},
+		{
+			params: map[string]string{"fsType": "btrfs"},
+			pass:   false,
+		},
+		{
+			params: map[string]string{"foo": "bar"},
+			pass:   false,
+		},
+	}
+
+	for _, tc := range tt {
+		result, err := parseVolumeParameters(tc.params)
+
+		if tc.pass {
+			require.NoError(t, err, "Expected parameters %v to pass", tc.params)
+			require.Equal(t, tc.expected, result)
+		} else {
+			require.Error(t, err, "Expected parameters %v to fail", tc.params)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package driver
 import (
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"strings"
 
@@ -10,11 +11,15 @@ import (
 )
 
 const (
-	disksByPathDir = "/dev/disk/by-path/"
+	disksByPathDir   = "/dev/disk/by-path/"
+	sysClassBlockDir = "/sys/class/block/"
 )
 
-func getDevicePath(log *logrus.Entry, pciBus, pciSlot int) (string, error) {
-	fileInfo, err := ioutil.ReadDir(disksByPathDir)
+// getDevicePath returns the path of the device on the given PCI bus and slot,
+// looked up under the given host root
+func getDevicePath(log *logrus.Entry, hostRoot string, pciBus, pciSlot int) (string, error) {
+	byPathDir := filepath.Join(hostRoot, disksByPathDir)
+	fileInfo, err := ioutil.ReadDir(byPathDir)
 	if err != nil {
 		return "", err
 	}
@@ -31,7 +36,7 @@ func getDevicePath(log *logrus.Entry, pciBus, pciSlot int) (string, error) {
 
 		log.Debugf("%s matched bus %d slot %d", file.Name(), pciBus, pciSlot)
 
-		resolvedLink, err := filepath.EvalSymlinks(fmt.Sprintf("%s/%s", disksByPathDir, file.Name()))
+		resolvedLink, err := filepath.EvalSymlinks(filepath.Join(byPathDir, file.Name()))
 		if err != nil {
 			return "", err
 		}
@@ -44,6 +49,20 @@ func getDevicePath(log *logrus.Entry, pciBus, pciSlot int) (string, error) {
 	return "", fmt.Errorf("Device not found in pci bus %d, slot %d", pciBus, pciSlot)
 }
 
+// rescanDevice asks the kernel to re-read the capacity of the given device.
+// Virtio block devices pick up a new capacity on their own and don't expose a
+// rescan trigger, in which case this is a no-op.
+func rescanDevice(log *logrus.Entry, hostRoot, devicePath string) error {
+	rescanPath := filepath.Join(hostRoot, sysClassBlockDir, filepath.Base(devicePath), "device", "rescan")
+	if _, err := os.Stat(rescanPath); os.IsNotExist(err) {
+		log.Debugf("Device %s has no rescan trigger, skipping", devicePath)
+		return nil
+	}
+
+	log.Debugf("Rescanning device %s", devicePath)
+	return ioutil.WriteFile(rescanPath, []byte("1"), 0200)
+}
+
 // compPathBusSlot returns true if the bus and slot match in the linuxPCIBusName
 func compPathBusSlot(linuxPCIBusName string, bus int, slot int) bool {
 	busHexStr := parseHexStr(bus)
@@ -0,0 +1,202 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"time"
+
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+)
+
+// retrier retries idempotent OVC API calls which failed with a transient
+// error, waiting exponentially longer between the attempts
+type retrier struct {
+	// attempts is the maximum number of times a call is made
+	attempts int
+	// initialDelay is the time waited before the first retry, it doubles
+	// for every next retry up to maxDelay
+	initialDelay time.Duration
+	maxDelay     time.Duration
+	log          *logrus.Entry
+}
+
+// newRetrier returns a retrier making at most 5 attempts over about 7
+// seconds, long enough to ride out a hiccup of the G8 API without making
+// the CO time out
+func newRetrier(log *logrus.Entry) *retrier {
+	return &retrier{
+		attempts:     5,
+		initialDelay: 500 * time.Millisecond,
+		maxDelay:     4 * time.Second,
+		log:          log,
+	}
+}
+
+// do calls fn until it succeeds, fails with an error that isn't transient
+// or the attempts run out, and returns its last error
+func (r *retrier) do(ctx context.Context, op string, fn func() error) error {
+	delay := r.initialDelay
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= r.attempts || errorCode(err) != codes.Unavailable {
+			return err
+		}
+
+		r.log.Warningf("%s failed with transient error: %s. Retrying in %s", op, err, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+		if delay > r.maxDelay {
+			delay = r.maxDelay
+		}
+	}
+}
+
+// withRetries returns a copy of the client retrying its read operations
+// with the given retrier. Operations that change resources aren't retried,
+// as a request failing with a transient error could still have been
+// executed.
+func (c *ovcClient) withRetries(r *retrier) *ovcClient {
+	retrying := *c
+	retrying.Disks = &retryingDiskService{c.Disks, r}
+	retrying.Machines = &retryingMachineService{c.Machines, r}
+	retrying.Accounts = &retryingAccountService{c.Accounts, r}
+	retrying.CloudSpaces = &retryingCloudSpaceService{c.CloudSpaces, r}
+	retrying.Locations = &retryingLocationService{c.Locations, r}
+	return &retrying
+}
+
+type retryingDiskService struct {
+	diskService
+	retrier *retrier
+}
+
+func (s *retryingDiskService) List(ctx context.Context, accountID int, diskType string) (*[]ovc.Disk, error) {
+	var disks *[]ovc.Disk
+	err := s.retrier.do(ctx, "Disks.List", func() (err error) {
+		disks, err = s.diskService.List(ctx, accountID, diskType)
+		return err
+	})
+	return disks, err
+}
+
+func (s *retryingDiskService) Get(ctx context.Context, diskID int) (*ovc.DiskInfo, error) {
+	var disk *ovc.DiskInfo
+	err := s.retrier.do(ctx, "Disks.Get", func() (err error) {
+		disk, err = s.diskService.Get(ctx, diskID)
+		return err
+	})
+	return disk, err
+}
+
+type retryingMachineService struct {
+	machineService
+	retrier *retrier
+}
+
+func (s *retryingMachineService) List(ctx context.Context, cloudspaceID int) (*[]ovc.Machine, error) {
+	var machines *[]ovc.Machine
+	err := s.retrier.do(ctx, "Machines.List", func() (err error) {
+		machines, err = s.machineService.List(ctx, cloudspaceID)
+		return err
+	})
+	return machines, err
+}
+
+func (s *retryingMachineService) Get(ctx context.Context, machineID int) (*ovc.MachineInfo, error) {
+	var machine *ovc.MachineInfo
+	err := s.retrier.do(ctx, "Machines.Get", func() (err error) {
+		machine, err = s.machineService.Get(ctx, machineID)
+		return err
+	})
+	return machine, err
+}
+
+func (s *retryingMachineService) GetByReferenceID(ctx context.Context, referenceID string) (*ovc.MachineInfo, error) {
+	var machine *ovc.MachineInfo
+	err := s.retrier.do(ctx, "Machines.GetByReferenceID", func() (err error) {
+		machine, err = s.machineService.GetByReferenceID(ctx, referenceID)
+		return err
+	})
+	return machine, err
+}
+
+type retryingAccountService struct {
+	accountService
+	retrier *retrier
+}
+
+func (s *retryingAccountService) GetIDByName(ctx context.Context, name string) (int, error) {
+	var accountID int
+	err := s.retrier.do(ctx, "Accounts.GetIDByName", func() (err error) {
+		accountID, err = s.accountService.GetIDByName(ctx, name)
+		return err
+	})
+	return accountID, err
+}
+
+func (s *retryingAccountService) Get(ctx context.Context, accountID int) (*AccountDetails, error) {
+	var account *AccountDetails
+	err := s.retrier.do(ctx, "Accounts.Get", func() (err error) {
+		account, err = s.accountService.Get(ctx, accountID)
+		return err
+	})
+	return account, err
+}
+
+type retryingCloudSpaceService struct {
+	cloudSpaceService
+	retrier *retrier
+}
+
+func (s *retryingCloudSpaceService) List(ctx context.Context) (*[]ovc.CloudSpaceInfo, error) {
+	var cloudspaces *[]ovc.CloudSpaceInfo
+	err := s.retrier.do(ctx, "CloudSpaces.List", func() (err error) {
+		cloudspaces, err = s.cloudSpaceService.List(ctx)
+		return err
+	})
+	return cloudspaces, err
+}
+
+func (s *retryingCloudSpaceService) Get(ctx context.Context, cloudspaceID int) (*ovc.CloudSpace, error) {
+	var cloudspace *ovc.CloudSpace
+	err := s.retrier.do(ctx, "CloudSpaces.Get", func() (err error) {
+		cloudspace, err = s.cloudSpaceService.Get(ctx, cloudspaceID)
+		return err
+	})
+	return cloudspace, err
+}
+
+type retryingLocationService struct {
+	locationService
+	retrier *retrier
+}
+
+func (s *retryingLocationService) List(ctx context.Context) (*ovc.LocationList, error) {
+	var locations *ovc.LocationList
+	err := s.retrier.do(ctx, "Locations.List", func() (err error) {
+		locations, err = s.locationService.List(ctx)
+		return err
+	})
+	return locations, err
+}
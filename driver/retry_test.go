@@ -0,0 +1,99 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRetries(t *testing.T) {
+	tt := []struct {
+		name     string
+		failure  error
+		failures int
+		calls    int
+		code     codes.Code
+	}{
+		{
+			name:     "transient failure",
+			failure:  errGateway("503 Service Temporarily Unavailable"),
+			failures: 2,
+			calls:    3,
+			code:     codes.OK,
+		},
+		{
+			name:     "persistent transient failure",
+			failure:  errGateway("503 Service Temporarily Unavailable"),
+			failures: 10,
+			calls:    4,
+			code:     codes.Unavailable,
+		},
+		{
+			name:     "job timeout",
+			failure:  errors.New("job timeout 3f1c0a5e-6a1b-4d8e-9a55-0d2b8c1e7f42"),
+			failures: 1,
+			calls:    2,
+			code:     codes.OK,
+		},
+		{
+			name:     "permanent failure",
+			failure:  errNotFound("disk", 1),
+			failures: 10,
+			calls:    1,
+			code:     codes.Internal,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+			f.failTimes("Disks.Get", tc.failure, tc.failures)
+			client := f.client().withRetries(&retrier{
+				attempts:     4,
+				initialDelay: time.Millisecond,
+				maxDelay:     2 * time.Millisecond,
+				log:          logrus.NewEntry(logrus.New()),
+			})
+
+			_, err := client.Disks.Get(context.Background(), diskID)
+			require.Equal(t, tc.code, status.Code(apiError(err)), "unexpected error: %v", err)
+			require.Equal(t, tc.calls, f.callCount("Disks.Get"))
+		})
+	}
+}
+
+func TestRetriesCanceled(t *testing.T) {
+	f := newFakeOVC()
+	f.failOn("Disks.List", errGateway("504 Gateway Time-out"))
+	client := f.client().withRetries(&retrier{
+		attempts:     4,
+		initialDelay: time.Hour,
+		maxDelay:     time.Hour,
+		log:          logrus.NewEntry(logrus.New()),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := client.Disks.List(ctx, f.accountID(), "")
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.Equal(t, 1, f.callCount("Disks.List"))
+}
+
+func TestRetriesSkipWrites(t *testing.T) {
+	f := newFakeOVC()
+	diskID := f.addDisk(f.accountID(), "pvc-1", 10)
+	f.failTimes("Disks.Resize", errGateway("502 Bad Gateway"), 1)
+	client := f.client().withRetries(newRetrier(logrus.NewEntry(logrus.New())))
+
+	err := client.Disks.Resize(context.Background(), &ovc.DiskConfig{DiskID: diskID, Size: 20})
+	require.Equal(t, codes.Unavailable, status.Code(apiError(err)))
+	require.Equal(t, 1, f.callCount("Disks.Resize"))
+}
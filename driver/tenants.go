@@ -0,0 +1,275 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Keys of the provisioner and controller publish secrets referenced by a
+// StorageClass, they match the keys of the secret of the driver
+const (
+	secretAccount      = "account"
+	secretJWT          = "client_jwt"
+	secretClientID     = "client_id"
+	secretClientSecret = "client_secret"
+)
+
+// clientCacheSize is the number of OVC clients created for the credentials
+// in the secrets of requests that are kept, the least recently used client
+// is dropped first
+const clientCacheSize = 16
+
+// tenant is the OVC account volumes are managed in, together with the client
+// to access it and the attacher of its disks
+type tenant struct {
+	client    *ovcClient
+	accountID int
+	attacher  *attacher
+}
+
+// cachedClient is an OVC client created for the credentials in a secret
+type cachedClient struct {
+	client    *ovcClient
+	accountID int
+	// used orders the clients by when they were last used
+	used uint64
+}
+
+// tenants holds the OVC clients created for the credentials in the secrets
+// of requests and the attachers of the accounts they manage
+type tenants struct {
+	// newClient creates an OVC client for the given configuration
+	newClient func(*ovc.Config) (*ovcClient, error)
+
+	mu sync.Mutex
+	// clients holds the clients by the hash of their account and
+	// credentials
+	clients map[string]*cachedClient
+	uses    uint64
+	// attachers holds the attachers of the accounts other than the one of
+	// the driver
+	attachers map[int]*attacher
+	stopped   bool
+}
+
+func newTenants(newClient func(*ovc.Config) (*ovcClient, error)) tenants {
+	return tenants{
+		newClient: newClient,
+		clients:   make(map[string]*cachedClient),
+		attachers: make(map[int]*attacher),
+	}
+}
+
+// defaultTenant returns the account and client of the driver
+func (d *Driver) defaultTenant() *tenant {
+	return &tenant{
+		client:    d.client,
+		accountID: d.accountID,
+		attacher:  d.attacher,
+	}
+}
+
+// tenant returns the account and client a request is handled with. Requests
+// without secrets use the account and credentials of the driver, others the
+// account and credentials in their secrets. Client credentials are used if
+// a secret contains both client credentials and a JWT.
+func (d *Driver) tenant(ctx context.Context, secrets map[string]string) (*tenant, error) {
+	if len(secrets) == 0 {
+		return d.defaultTenant(), nil
+	}
+
+	account := secrets[secretAccount]
+	if account == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "secret has no %s", secretAccount)
+	}
+	config := ovc.Config{
+		URL:     d.url,
+		Verbose: d.verbose,
+	}
+	switch {
+	case secrets[secretClientID] != "" || secrets[secretClientSecret] != "":
+		if secrets[secretClientID] == "" || secrets[secretClientSecret] == "" {
+			return nil, status.Errorf(codes.InvalidArgument, "secret needs both %s and %s", secretClientID, secretClientSecret)
+		}
+		config.ClientID = secrets[secretClientID]
+		config.ClientSecret = secrets[secretClientSecret]
+	case secrets[secretJWT] != "":
+		config.JWT = secrets[secretJWT]
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "secret has no %s or %s and %s", secretJWT, secretClientID, secretClientSecret)
+	}
+
+	client, accountID, err := d.cachedClient(ctx, account, &config)
+	if err != nil {
+		return nil, err
+	}
+	attacher, err := d.attacherFor(accountID, client)
+	if err != nil {
+		return nil, err
+	}
+	return &tenant{
+		client:    client,
+		accountID: accountID,
+		attacher:  attacher,
+	}, nil
+}
+
+// cachedClient returns the client for the given account and credentials and
+// the ID of the account, creating the client if it isn't cached
+func (d *Driver) cachedClient(ctx context.Context, account string, config *ovc.Config) (*ovcClient, int, error) {
+	key := credentialsKey(account, config)
+
+	d.tenants.mu.Lock()
+	cached, ok := d.tenants.clients[key]
+	if ok {
+		d.tenants.uses++
+		cached.used = d.tenants.uses
+	}
+	d.tenants.mu.Unlock()
+
+	if ok {
+		// Getting the JWT fetches a new one if it was fetched with client
+		// credentials and is about to expire
+		if _, err := cached.client.JWT.Get(ctx); err != nil {
+			d.tenants.mu.Lock()
+			delete(d.tenants.clients, key)
+			d.tenants.mu.Unlock()
+			return nil, 0, status.Errorf(codes.Unauthenticated, "credentials of account %s are not valid: %s", account, err)
+		}
+		return cached.client, cached.accountID, nil
+	}
+
+	var client *ovcClient
+	err := withContext(ctx, func() (err error) {
+		client, err = d.tenants.newClient(config)
+		return err
+	})
+	if err != nil {
+		return nil, 0, status.Errorf(codes.Unauthenticated, "failed to authenticate for account %s: %s", account, err)
+	}
+	client = client.instrumentedTenant(d.metrics).withRetries(newRetrier(d.log))
+
+	accountID, err := client.Accounts.GetIDByName(ctx, account)
+	if err != nil {
+		return nil, 0, apiError(err)
+	}
+
+	d.tenants.mu.Lock()
+	defer d.tenants.mu.Unlock()
+	d.tenants.uses++
+	d.tenants.clients[key] = &cachedClient{
+		client:    client,
+		accountID: accountID,
+		used:      d.tenants.uses,
+	}
+	if len(d.tenants.clients) > clientCacheSize {
+		var oldest string
+		for k, c := range d.tenants.clients {
+			if oldest == "" || c.used < d.tenants.clients[oldest].used {
+				oldest = k
+			}
+		}
+		delete(d.tenants.clients, oldest)
+	}
+	d.log.WithField("account_id", accountID).Infof("Created OVC client for account %s", account)
+	return client, accountID, nil
+}
+
+// credentialsKey returns the key of the client for the given account and
+// credentials in the client cache, the credentials are hashed so they aren't
+// kept in memory longer than the client
+func credentialsKey(account string, config *ovc.Config) string {
+	h := sha256.New()
+	for _, s := range []string{account, config.JWT, config.ClientID, config.ClientSecret} {
+		h.Write([]byte(s))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// attacherFor returns the attacher of the disks of an account. Accounts
+// other than the one of the driver get their own attacher, which uses the
+// client of the latest request for the account.
+func (d *Driver) attacherFor(accountID int, client *ovcClient) (*attacher, error) {
+	if accountID == d.accountID || d.attacher == nil {
+		return d.attacher, nil
+	}
+
+	d.tenants.mu.Lock()
+	defer d.tenants.mu.Unlock()
+	if d.tenants.stopped {
+		return nil, errAttacherStopped
+	}
+	a, ok := d.tenants.attachers[accountID]
+	if ok {
+		a.setClient(client)
+		return a, nil
+	}
+	a = newAttacher(client, accountID, d.attacherConfig, d.log.WithField("account_id", accountID))
+	a.start()
+	d.tenants.attachers[accountID] = a
+	return a, nil
+}
+
+// attachers returns the attacher of the driver followed by the attachers of
+// the other accounts
+func (d *Driver) attachers() []*attacher {
+	if d.attacher == nil {
+		return nil
+	}
+	return append([]*attacher{d.attacher}, d.tenantAttachers()...)
+}
+
+// tenantAttachers returns the attachers of the accounts other than the one
+// of the driver
+func (d *Driver) tenantAttachers() []*attacher {
+	d.tenants.mu.Lock()
+	defer d.tenants.mu.Unlock()
+	var attachers []*attacher
+	for _, a := range d.tenants.attachers {
+		attachers = append(attachers, a)
+	}
+	return attachers
+}
+
+// stopTenantAttachers stops the attachers of the accounts other than the one
+// of the driver in parallel, waiting up to timeout for their queued
+// operations to finish
+func (d *Driver) stopTenantAttachers(timeout time.Duration) {
+	d.tenants.mu.Lock()
+	d.tenants.stopped = true
+	d.tenants.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, a := range d.tenantAttachers() {
+		wg.Add(1)
+		go func(a *attacher) {
+			defer wg.Done()
+			a.stop(timeout)
+		}(a)
+	}
+	wg.Wait()
+}
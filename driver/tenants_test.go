@@ -0,0 +1,223 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const tenantAccountName = "team-account"
+
+// newTenantDriver returns a controller driver backed by the given fake that
+// records the configurations of the clients it creates for secrets
+func newTenantDriver(t *testing.T, f *fakeOVC) (*Driver, *[]ovc.Config) {
+	d := newTestDriver(t, f)
+	var configs []ovc.Config
+	d.tenants.newClient = func(config *ovc.Config) (*ovcClient, error) {
+		configs = append(configs, *config)
+		return f.client(), nil
+	}
+	return d, &configs
+}
+
+func TestTenantSecrets(t *testing.T) {
+	tt := []struct {
+		name    string
+		secrets map[string]string
+		code    codes.Code
+		config  ovc.Config
+	}{
+		{
+			name:    "JWT",
+			secrets: map[string]string{secretAccount: tenantAccountName, secretJWT: "jwt"},
+			config:  ovc.Config{JWT: "jwt"},
+		},
+		{
+			name:    "client credentials",
+			secrets: map[string]string{secretAccount: tenantAccountName, secretClientID: "id", secretClientSecret: "secret"},
+			config:  ovc.Config{ClientID: "id", ClientSecret: "secret"},
+		},
+		{
+			name:    "client credentials take precedence",
+			secrets: map[string]string{secretAccount: tenantAccountName, secretJWT: "jwt", secretClientID: "id", secretClientSecret: "secret"},
+			config:  ovc.Config{ClientID: "id", ClientSecret: "secret"},
+		},
+		{
+			name:    "missing account",
+			secrets: map[string]string{secretJWT: "jwt"},
+			code:    codes.InvalidArgument,
+		},
+		{
+			name:    "missing credentials",
+			secrets: map[string]string{secretAccount: tenantAccountName},
+			code:    codes.InvalidArgument,
+		},
+		{
+			name:    "missing client secret",
+			secrets: map[string]string{secretAccount: tenantAccountName, secretClientID: "id"},
+			code:    codes.InvalidArgument,
+		},
+		{
+			name:    "unknown account",
+			secrets: map[string]string{secretAccount: "unknown", secretJWT: "jwt"},
+			code:    codes.NotFound,
+		},
+	}
+
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeOVC()
+			accountID := f.addAccount(tenantAccountName, -1)
+			d, configs := newTenantDriver(t, f)
+
+			tenant, err := d.tenant(context.Background(), tc.secrets)
+			require.Equal(t, tc.code, status.Code(err), "%v", err)
+			if tc.code != codes.OK {
+				return
+			}
+			require.Equal(t, accountID, tenant.accountID)
+			require.NotEqual(t, d.attacher, tenant.attacher)
+			require.Len(t, *configs, 1)
+			require.Equal(t, tc.config.JWT, (*configs)[0].JWT)
+			require.Equal(t, tc.config.ClientID, (*configs)[0].ClientID)
+			require.Equal(t, tc.config.ClientSecret, (*configs)[0].ClientSecret)
+		})
+	}
+}
+
+func TestTenantVolumeLifecycle(t *testing.T) {
+	f := newFakeOVC()
+	accountID := f.addAccount(tenantAccountName, -1)
+	machineID := f.addMachine(f.addCloudSpace(accountID, -1))
+	d, configs := newTenantDriver(t, f)
+	secrets := map[string]string{secretAccount: tenantAccountName, secretJWT: "jwt"}
+	ctx := context.Background()
+
+	created, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "team-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Secrets:            secrets,
+	})
+	require.NoError(t, err)
+	diskID, err := strconv.Atoi(created.Volume.VolumeId)
+	require.NoError(t, err)
+	require.Equal(t, accountID, f.disk(diskID).AccountID)
+
+	_, err = d.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+		VolumeId:         created.Volume.VolumeId,
+		NodeId:           strconv.Itoa(machineID),
+		VolumeCapability: mountCapability(),
+		Secrets:          secrets,
+	})
+	require.NoError(t, err)
+	require.Equal(t, machineID, f.attachedTo(diskID))
+
+	_, err = d.ControllerUnpublishVolume(ctx, &csi.ControllerUnpublishVolumeRequest{
+		VolumeId: created.Volume.VolumeId,
+		NodeId:   strconv.Itoa(machineID),
+		Secrets:  secrets,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 0, f.attachedTo(diskID))
+
+	_, err = d.DeleteVolume(ctx, &csi.DeleteVolumeRequest{
+		VolumeId: created.Volume.VolumeId,
+		Secrets:  secrets,
+	})
+	require.NoError(t, err)
+	require.Nil(t, f.disk(diskID))
+
+	// All requests shared the cached client
+	require.Len(t, *configs, 1)
+}
+
+func TestClientCache(t *testing.T) {
+	f := newFakeOVC()
+	f.addAccount(tenantAccountName, -1)
+	d, configs := newTenantDriver(t, f)
+	ctx := context.Background()
+
+	for i := 0; i <= clientCacheSize; i++ {
+		_, err := d.tenant(ctx, map[string]string{secretAccount: tenantAccountName, secretJWT: fmt.Sprintf("jwt-%d", i)})
+		require.NoError(t, err)
+	}
+	require.Len(t, *configs, clientCacheSize+1)
+	require.Len(t, d.tenants.clients, clientCacheSize)
+	// The clients share the attacher of the account
+	require.Len(t, d.tenantAttachers(), 1)
+
+	// The least recently used client was dropped
+	_, err := d.tenant(ctx, map[string]string{secretAccount: tenantAccountName, secretJWT: "jwt-0"})
+	require.NoError(t, err)
+	require.Len(t, *configs, clientCacheSize+2)
+	_, err = d.tenant(ctx, map[string]string{secretAccount: tenantAccountName, secretJWT: "jwt-0"})
+	require.NoError(t, err)
+	require.Len(t, *configs, clientCacheSize+2)
+}
+
+func TestClientCacheDropsExpiredClient(t *testing.T) {
+	f := newFakeOVC()
+	f.addAccount(tenantAccountName, -1)
+	d, configs := newTenantDriver(t, f)
+	secrets := map[string]string{secretAccount: tenantAccountName, secretJWT: "jwt"}
+	ctx := context.Background()
+
+	_, err := d.tenant(ctx, secrets)
+	require.NoError(t, err)
+
+	require.NoError(t, f.client().JWT.Set(newFakeJWT(time.Now().Add(-time.Minute))))
+	_, err = d.tenant(ctx, secrets)
+	require.Equal(t, codes.Unauthenticated, status.Code(err), "%v", err)
+	require.Empty(t, d.tenants.clients)
+
+	// The next request authenticates again
+	require.NoError(t, f.client().JWT.Set(newFakeJWT(time.Now().Add(time.Hour))))
+	_, err = d.tenant(ctx, secrets)
+	require.NoError(t, err)
+	require.Len(t, *configs, 2)
+}
+
+func TestTenantExpand(t *testing.T) {
+	f := newFakeOVC()
+	// The volumes of the tenant are not visible to the account of the driver
+	tenantOVC := newFakeOVC()
+	tenantOVC.addAccount(tenantAccountName, -1)
+	d := newTestDriver(t, f)
+	d.tenants.newClient = func(config *ovc.Config) (*ovcClient, error) {
+		return tenantOVC.client(), nil
+	}
+	secrets := map[string]string{secretAccount: tenantAccountName, secretJWT: "jwt"}
+	ctx := context.Background()
+
+	created, err := d.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "team-volume",
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Secrets:            secrets,
+	})
+	require.NoError(t, err)
+	diskID, err := strconv.Atoi(created.Volume.VolumeId)
+	require.NoError(t, err)
+
+	_, err = d.ValidateVolumeCapabilities(ctx, &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           created.Volume.VolumeId,
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability()},
+		Secrets:            secrets,
+	})
+	require.NoError(t, err)
+
+	_, err = d.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      created.Volume.VolumeId,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 20 * GiB},
+		Secrets:       secrets,
+	})
+	require.NoError(t, err)
+	require.Equal(t, 20, tenantOVC.disk(diskID).SizeMax)
+}
@@ -0,0 +1,108 @@
+/*
+Copyright 2018-2019 GIG TECHNOLOGY NV
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+)
+
+const (
+	// topologyKeyGrid is the topology key of the G8 grid a volume or node
+	// lives in
+	topologyKeyGrid = "topology.disk.ovc.csi.gig.tech/grid"
+	// topologyKeyLocation is the topology key of the G8 location code a
+	// volume or node lives in
+	topologyKeyLocation = "topology.disk.ovc.csi.gig.tech/location"
+)
+
+// locationTopology returns the topology segments of a location
+func locationTopology(location ovc.LocationInfo) *csi.Topology {
+	return &csi.Topology{
+		Segments: map[string]string{
+			topologyKeyGrid:     strconv.Itoa(location.GridID),
+			topologyKeyLocation: location.Code,
+		},
+	}
+}
+
+// locationByGridID returns the location of the given grid, or nil if the grid
+// is unknown
+func (d *Driver) locationByGridID(gridID int) *ovc.LocationInfo {
+	for i, location := range d.locations {
+		if location.GridID == gridID {
+			return &d.locations[i]
+		}
+	}
+	return nil
+}
+
+// locationByTopology returns the location matching all known segments of the
+// given topology, or nil if there is none
+func (d *Driver) locationByTopology(topology *csi.Topology) *ovc.LocationInfo {
+	segments := topology.GetSegments()
+	gridID, hasGrid := segments[topologyKeyGrid]
+	code, hasCode := segments[topologyKeyLocation]
+	if !hasGrid && !hasCode {
+		return nil
+	}
+
+	for i, location := range d.locations {
+		if hasGrid && gridID != strconv.Itoa(location.GridID) {
+			continue
+		}
+		if hasCode && code != location.Code {
+			continue
+		}
+		return &d.locations[i]
+	}
+	return nil
+}
+
+// pickLocation returns the location a volume should be created in to satisfy
+// the given accessibility requirements. Preferred topologies are tried before
+// requisite ones. Without requirements the location of the node is used when
+// the driver runs on one, or the only location of the G8. It returns nil if
+// none of the requirements can be satisfied, or if there are no requirements
+// and the location is ambiguous.
+func (d *Driver) pickLocation(requirements *csi.TopologyRequirement) *ovc.LocationInfo {
+	if requirements == nil || (len(requirements.GetPreferred()) == 0 && len(requirements.GetRequisite()) == 0) {
+		if location := d.locationByGridID(d.nodeGridID); location != nil {
+			return location
+		}
+		if len(d.locations) == 1 {
+			return &d.locations[0]
+		}
+		return nil
+	}
+
+	for _, topology := range requirements.GetPreferred() {
+		if location := d.locationByTopology(topology); location != nil {
+			return location
+		}
+	}
+
+	for _, topology := range requirements.GetRequisite() {
+		if location := d.locationByTopology(topology); location != nil {
+			return location
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPickLocation(t *testing.T) {
+	d := &Driver{
+		locations: ovc.LocationList{
+			{GridID: 1, Code: "be-g8-1"},
+			{GridID: 2, Code: "be-g8-2"},
+		},
+	}
+
+	topology := func(segments map[string]string) *csi.Topology {
+		return &csi.Topology{Segments: segments}
+	}
+
+	tt := []struct {
+		requirements *csi.TopologyRequirement
+		gridID       int
+		pass         bool
+	}{
+		{
+			// The location is ambiguous without requirements
+			requirements: nil,
+			pass:         false,
+		},
+		{
+			requirements: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topology(map[string]string{topologyKeyGrid: "2"})},
+			},
+			gridID: 2,
+			pass:   true,
+		},
+		{
+			requirements: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					topology(map[string]string{topologyKeyGrid: "1"}),
+					topology(map[string]string{topologyKeyLocation: "be-g8-2"}),
+				},
+				Preferred: []*csi.Topology{topology(map[string]string{topologyKeyLocation: "be-g8-2"})},
+			},
+			gridID: 2,
+			pass:   true,
+		},
+		{
+			requirements: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topology(map[string]string{topologyKeyGrid: "2", topologyKeyLocation: "be-g8-1"})},
+			},
+			pass: false,
+		},
+		{
+			requirements: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topology(map[string]string{topologyKeyGrid: "3"})},
+			},
+			pass: false,
+		},
+	}
+
+	for _, tc := range tt {
+		location := d.pickLocation(tc.requirements)
+
+		if tc.pass {
+			require.NotNil(t, location, "Expected requirements %v to be satisfied", tc.requirements)
+			require.Equal(t, tc.gridID, location.GridID)
+		} else {
+			require.Nil(t, location, "Expected requirements %v not to be satisfied", tc.requirements)
+		}
+	}
+}
+
+func TestPickLocationWithoutRequirements(t *testing.T) {
+	locations := ovc.LocationList{
+		{GridID: 1, Code: "be-g8-1"},
+		{GridID: 2, Code: "be-g8-2"},
+	}
+
+	// A node uses its own location
+	d := &Driver{locations: locations, nodeGridID: 2}
+	location := d.pickLocation(&csi.TopologyRequirement{})
+	require.NotNil(t, location)
+	require.Equal(t, 2, location.GridID)
+
+	// A controller uses the only location of the G8
+	d = &Driver{locations: locations[:1]}
+	location = d.pickLocation(nil)
+	require.NotNil(t, location)
+	require.Equal(t, 1, location.GridID)
+}
@@ -17,23 +17,25 @@ limitations under the License.
 package driver
 
 import (
+	"context"
 	"io/ioutil"
+	"path/filepath"
 	"strconv"
 	"strings"
-
-	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
 )
 
 const uuidPath = "/sys/class/dmi/id/product_uuid"
 
-func getNodeID(client *ovc.Client) (string, int, error) {
-	rawID, err := ioutil.ReadFile(uuidPath)
+// getNodeID looks up the machine the driver runs on by the DMI product UUID
+// found under the given host root, and returns its ID and cloudspace ID
+func getNodeID(ctx context.Context, hostRoot string, machines machineService) (string, int, error) {
+	rawID, err := ioutil.ReadFile(filepath.Join(hostRoot, uuidPath))
 	if err != nil {
 		return "", 0, err
 	}
 	id := strings.ToLower(strings.TrimSpace(string(rawID)))
 
-	machine, err := client.Machines.GetByReferenceID(id)
+	machine, err := machines.GetByReferenceID(ctx, id)
 	if err != nil {
 		return "", 0, err
 	}
@@ -0,0 +1,318 @@
+package sanity
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+const (
+	fakeAccountID    = 1
+	fakeAccountName  = "sanity"
+	fakeCloudSpaceID = 2
+	fakeGridID       = 1
+	fakeLocationCode = "be-sanity-1"
+)
+
+// fakeOVCAPI is an in-memory fake of the OVC REST endpoints used by the
+// driver. Like the real API, every call returns a task ID of which the result
+// is fetched through /system/task/get.
+type fakeOVCAPI struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	lastID   int
+	tasks    map[string]interface{}
+	machines map[int]*fakeMachine
+	disks    map[int]*fakeDisk
+}
+
+type fakeMachine struct {
+	ID           int    `json:"id"`
+	ReferenceID  string `json:"referenceId"`
+	Status       string `json:"status"`
+	CloudspaceID int    `json:"cloudspaceid"`
+}
+
+type fakeDisk struct {
+	ID          int    `json:"id"`
+	AccountID   int    `json:"accountId"`
+	GridID      int    `json:"gid"`
+	Name        string `json:"name"`
+	Description string `json:"descr"`
+	Size        int    `json:"sizeMax"`
+	Type        string `json:"type"`
+	Status      string `json:"status"`
+	MachineID   int    `json:"-"`
+}
+
+// apiError is returned by an endpoint to make the initial request fail with
+// the given HTTP status code
+type apiError struct {
+	code    int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func notFound(format string, a ...interface{}) error {
+	return &apiError{code: http.StatusNotFound, message: fmt.Sprintf(format, a...)}
+}
+
+func badRequest(format string, a ...interface{}) error {
+	return &apiError{code: http.StatusBadRequest, message: fmt.Sprintf(format, a...)}
+}
+
+// newFakeOVCAPI starts a fake OVC API with a single account, cloudspace and
+// machine
+func newFakeOVCAPI() *fakeOVCAPI {
+	api := &fakeOVCAPI{
+		tasks:    make(map[string]interface{}),
+		machines: make(map[int]*fakeMachine),
+		disks:    make(map[int]*fakeDisk),
+		lastID:   fakeCloudSpaceID,
+	}
+	api.addMachine()
+	api.Server = httptest.NewServer(http.HandlerFunc(api.serveHTTP))
+	return api
+}
+
+func (api *fakeOVCAPI) nextID() int {
+	api.lastID++
+	return api.lastID
+}
+
+// addMachine adds a running machine to the cloudspace and returns its ID
+func (api *fakeOVCAPI) addMachine() int {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	id := api.nextID()
+	api.machines[id] = &fakeMachine{
+		ID:           id,
+		ReferenceID:  fmt.Sprintf("machine-%d", id),
+		Status:       "RUNNING",
+		CloudspaceID: fakeCloudSpaceID,
+	}
+	return id
+}
+
+func (api *fakeOVCAPI) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	params := make(map[string]interface{})
+	if r.Body != nil {
+		json.NewDecoder(r.Body).Decode(&params)
+	}
+	endpoint := strings.TrimPrefix(r.URL.Path, "/restmachine")
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	if endpoint == "/system/task/get" {
+		taskID, _ := params["taskguid"].(string)
+		result, ok := api.tasks[taskID]
+		if !ok {
+			http.Error(w, "task not found", http.StatusNotFound)
+			return
+		}
+		delete(api.tasks, taskID)
+		json.NewEncoder(w).Encode([]interface{}{true, result})
+		return
+	}
+
+	result, err := api.handle(endpoint, params)
+	if err != nil {
+		code := http.StatusInternalServerError
+		if apiErr, ok := err.(*apiError); ok {
+			code = apiErr.code
+		}
+		http.Error(w, err.Error(), code)
+		return
+	}
+
+	taskID := fmt.Sprintf("task-%d", api.nextID())
+	api.tasks[taskID] = result
+	fmt.Fprintf(w, "%q", taskID)
+}
+
+func (api *fakeOVCAPI) handle(endpoint string, params map[string]interface{}) (interface{}, error) {
+	switch endpoint {
+	case "/cloudapi/locations/list":
+		return []map[string]interface{}{
+			{"gid": fakeGridID, "locationCode": fakeLocationCode},
+		}, nil
+
+	case "/cloudapi/accounts/list":
+		return []map[string]interface{}{
+			{"id": fakeAccountID, "name": fakeAccountName},
+		}, nil
+
+	case "/cloudapi/accounts/get":
+		return map[string]interface{}{
+			"id":             fakeAccountID,
+			"name":           fakeAccountName,
+			"resourceLimits": map[string]interface{}{"CU_D": -1},
+		}, nil
+
+	case "/cloudapi/cloudspaces/list":
+		return []map[string]interface{}{
+			{"id": fakeCloudSpaceID, "accountId": fakeAccountID, "gid": fakeGridID},
+		}, nil
+
+	case "/cloudapi/cloudspaces/get":
+		if intParam(params, "cloudspaceId") != fakeCloudSpaceID {
+			return nil, notFound("cloudspace not found")
+		}
+		return map[string]interface{}{
+			"id":             fakeCloudSpaceID,
+			"accountId":      fakeAccountID,
+			"gid":            fakeGridID,
+			"resourceLimits": map[string]interface{}{"CU_D": -1},
+		}, nil
+
+	case "/cloudapi/machines/list":
+		machines := []map[string]interface{}{}
+		for _, machine := range api.machines {
+			if machine.CloudspaceID == intParam(params, "cloudspaceId") {
+				machines = append(machines, map[string]interface{}{
+					"id":          machine.ID,
+					"referenceId": machine.ReferenceID,
+					"status":      machine.Status,
+					"disks":       api.machineDisks(machine.ID),
+				})
+			}
+		}
+		return machines, nil
+
+	case "/cloudapi/machines/get":
+		machine, ok := api.machines[intParam(params, "machineId")]
+		if !ok {
+			return nil, notFound("machine not found")
+		}
+		return machine, nil
+
+	case "/cloudapi/machines/getByReferenceId":
+		for _, machine := range api.machines {
+			if machine.ReferenceID == params["referenceId"] {
+				return machine.ID, nil
+			}
+		}
+		return nil, notFound("machine not found")
+
+	case "/cloudapi/machines/attachDisk":
+		disk, err := api.disk(params)
+		if err != nil {
+			return nil, err
+		}
+		machineID := intParam(params, "machineId")
+		if _, ok := api.machines[machineID]; !ok {
+			return nil, notFound("machine not found")
+		}
+		if disk.MachineID != 0 {
+			return nil, badRequest("disk is already attached to machine %d", disk.MachineID)
+		}
+		disk.MachineID = machineID
+		return true, nil
+
+	case "/cloudapi/machines/detachDisk":
+		disk, err := api.disk(params)
+		if err != nil {
+			return nil, err
+		}
+		if disk.MachineID != intParam(params, "machineId") {
+			return nil, badRequest("disk is not attached to machine")
+		}
+		disk.MachineID = 0
+		return true, nil
+
+	case "/cloudapi/disks/list":
+		disks := []map[string]interface{}{}
+		for _, disk := range api.disks {
+			if disk.AccountID == intParam(params, "accountId") {
+				disks = append(disks, map[string]interface{}{
+					"id":          disk.ID,
+					"accountId":   disk.AccountID,
+					"name":        disk.Name,
+					"description": disk.Description,
+					"sizeMax":     disk.Size,
+					"type":        disk.Type,
+					"status":      disk.Status,
+				})
+			}
+		}
+		return disks, nil
+
+	case "/cloudapi/disks/get":
+		return api.disk(params)
+
+	case "/cloudapi/disks/create":
+		disk := &fakeDisk{
+			ID:          api.nextID(),
+			AccountID:   intParam(params, "accountId"),
+			GridID:      intParam(params, "gid"),
+			Name:        stringParam(params, "name"),
+			Description: stringParam(params, "description"),
+			Size:        intParam(params, "size"),
+			Type:        stringParam(params, "type"),
+			Status:      "CREATED",
+		}
+		api.disks[disk.ID] = disk
+		return disk.ID, nil
+
+	case "/cloudapi/disks/delete":
+		disk, err := api.disk(params)
+		if err != nil {
+			return nil, err
+		}
+		if disk.MachineID != 0 && params["detach"] != true {
+			return nil, badRequest("disk is attached to a machine")
+		}
+		delete(api.disks, disk.ID)
+		return true, nil
+
+	case "/cloudapi/disks/resize":
+		disk, err := api.disk(params)
+		if err != nil {
+			return nil, err
+		}
+		size := intParam(params, "size")
+		if size < disk.Size {
+			return nil, badRequest("disk can not be shrunk")
+		}
+		disk.Size = size
+		return true, nil
+	}
+
+	return nil, notFound("unknown endpoint %s", endpoint)
+}
+
+func (api *fakeOVCAPI) disk(params map[string]interface{}) (*fakeDisk, error) {
+	disk, ok := api.disks[intParam(params, "diskId")]
+	if !ok {
+		return nil, notFound("disk not found")
+	}
+	return disk, nil
+}
+
+func (api *fakeOVCAPI) machineDisks(machineID int) []int {
+	disks := []int{}
+	for _, disk := range api.disks {
+		if disk.MachineID == machineID {
+			disks = append(disks, disk.ID)
+		}
+	}
+	return disks
+}
+
+func intParam(params map[string]interface{}, key string) int {
+	value, _ := params[key].(float64)
+	return int(value)
+}
+
+func stringParam(params map[string]interface{}, key string) string {
+	value, _ := params[key].(string)
+	return value
+}
@@ -0,0 +1,82 @@
+package sanity
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gig-tech/ovc-disk-csi-driver/driver"
+	"github.com/gig-tech/ovc-sdk-go/v3/ovc"
+	"github.com/kubernetes-csi/csi-test/pkg/sanity"
+	"github.com/onsi/ginkgo/config"
+	"github.com/stretchr/testify/require"
+)
+
+// nodeSpecs matches the sanity specs which need the node service, which
+// can't run outside of a G8 VM
+const nodeSpecs = `Node Service|ControllerPublishVolume should return appropriate values|ControllerUnpublishVolume should return appropriate values`
+
+func TestSanity(t *testing.T) {
+	api := newFakeOVCAPI()
+	defer api.Close()
+
+	tmpDir, err := ioutil.TempDir("", "ovc-csi-sanity")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmpDir)
+
+	endpoint := "unix://" + filepath.Join(tmpDir, "csi.sock")
+	drv, err := driver.NewDriver(&driver.Config{
+		URL:      api.URL,
+		Endpoint: endpoint,
+		Account:  fakeAccountName,
+		JWT:      newTestJWT(t),
+		Mode:     driver.ControllerMode,
+	})
+	require.NoError(t, err)
+	defer drv.Stop()
+
+	go func() {
+		if err := drv.Run(); err != nil {
+			t.Errorf("driver stopped: %s", err)
+		}
+	}()
+
+	config.GinkgoConfig.SkipString = nodeSpecs
+	sanity.Test(t, &sanity.Config{
+		Address:        endpoint,
+		TargetPath:     filepath.Join(tmpDir, "target"),
+		StagingPath:    filepath.Join(tmpDir, "staging"),
+		TestVolumeSize: 1 * driver.GiB,
+	})
+}
+
+// newTestJWT returns a JWT signed with a key which is registered with the OVC
+// SDK as the key of the identity provider
+func newTestJWT(t *testing.T) string {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+
+	publicKey, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	require.NoError(t, err)
+	err = ovc.SetJWTPublicKey(string(pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: publicKey,
+	})))
+	require.NoError(t, err)
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodES384, jwt.MapClaims{
+		"username": "sanity",
+		"exp":      time.Now().Add(24 * time.Hour).Unix(),
+	}).SignedString(key)
+	require.NoError(t, err)
+
+	return token
+}